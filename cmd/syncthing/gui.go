@@ -80,11 +80,15 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	getRestMux.HandleFunc("/rest/completion", withModel(m, restGetCompletion))
 	getRestMux.HandleFunc("/rest/config", restGetConfig)
 	getRestMux.HandleFunc("/rest/config/sync", restGetConfigInSync)
+	getRestMux.HandleFunc("/rest/conflicts", withModel(m, restGetConflicts))
 	getRestMux.HandleFunc("/rest/connections", withModel(m, restGetConnections))
 	getRestMux.HandleFunc("/rest/discovery", restGetDiscovery)
 	getRestMux.HandleFunc("/rest/errors", restGetErrors)
 	getRestMux.HandleFunc("/rest/events", restGetEvents)
+	getRestMux.HandleFunc("/rest/failed", withModel(m, restGetFailed))
+	getRestMux.HandleFunc("/rest/held", withModel(m, restGetHeld))
 	getRestMux.HandleFunc("/rest/lang", restGetLang)
+	getRestMux.HandleFunc("/rest/localchanges", withModel(m, restGetLocalChanges))
 	getRestMux.HandleFunc("/rest/model", withModel(m, restGetModel))
 	getRestMux.HandleFunc("/rest/model/version", withModel(m, restGetModelVersion))
 	getRestMux.HandleFunc("/rest/need", withModel(m, restGetNeed))
@@ -105,8 +109,13 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	postRestMux.HandleFunc("/rest/error", restPostError)
 	postRestMux.HandleFunc("/rest/error/clear", restClearErrors)
 	postRestMux.HandleFunc("/rest/model/override", withModel(m, restPostOverride))
+	postRestMux.HandleFunc("/rest/node/pause", withModel(m, restPostNodePause))
+	postRestMux.HandleFunc("/rest/node/resume", withModel(m, restPostNodeResume))
+	postRestMux.HandleFunc("/rest/repo/pause", withModel(m, restPostRepoPause))
+	postRestMux.HandleFunc("/rest/repo/resume", withModel(m, restPostRepoResume))
 	postRestMux.HandleFunc("/rest/reset", restPostReset)
 	postRestMux.HandleFunc("/rest/restart", restPostRestart)
+	postRestMux.HandleFunc("/rest/revert", withModel(m, restPostRevert))
 	postRestMux.HandleFunc("/rest/shutdown", restPostShutdown)
 	postRestMux.HandleFunc("/rest/upgrade", restPostUpgrade)
 	postRestMux.HandleFunc("/rest/scan", withModel(m, restPostScan))
@@ -264,6 +273,44 @@ func restPostOverride(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	go m.Override(repo)
 }
 
+func restPostRepoPause(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	if err := m.PauseRepo(repo); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostRepoResume(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	if err := m.ResumeRepo(repo); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostNodePause(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	node, err := protocol.NodeIDFromString(qs.Get("node"))
+	if err == nil {
+		err = m.PauseNode(node)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostNodeResume(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	node, err := protocol.NodeIDFromString(qs.Get("node"))
+	if err == nil {
+		err = m.ResumeNode(node)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var repo = qs.Get("repo")
@@ -274,6 +321,54 @@ func restGetNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(files)
 }
 
+func restGetLocalChanges(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	changes := m.LocalChanges(repo)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func restPostRevert(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+	if err := m.Revert(repo); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restGetConflicts(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	conflicts := m.Conflicts(repo)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+func restGetFailed(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	failed := m.FailedItems(repo)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(failed)
+}
+
+func restGetHeld(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var repo = qs.Get("repo")
+
+	held := m.HeldFiles(repo)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(held)
+}
+
 func restGetConnections(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var res = m.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
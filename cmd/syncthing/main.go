@@ -585,7 +585,7 @@ func syncthingMain() {
 		}
 	}
 
-	m := model.NewModel(confDir, &cfg, myName, "syncthing", Version, db)
+	m := model.NewModel(confDir, &cfg, myID, myName, "syncthing", Version, db)
 
 nextRepo:
 	for i, repo := range cfg.Repositories {
@@ -665,21 +665,6 @@ nextRepo:
 		}
 	}
 
-	// Clear out old indexes for other nodes. Otherwise we'll start up and
-	// start needing a bunch of files which are nowhere to be found. This
-	// needs to be changed when we correctly do persistent indexes.
-	for _, repoCfg := range cfg.Repositories {
-		if repoCfg.Invalid != "" {
-			continue
-		}
-		for _, node := range repoCfg.NodeIDs() {
-			if node == myID {
-				continue
-			}
-			m.Index(node, repoCfg.ID, nil)
-		}
-	}
-
 	// Walk the repository and update the local model before establishing any
 	// connections to other nodes.
 
@@ -741,7 +726,13 @@ nextRepo:
 			m.StartRepoRO(repo.ID)
 		} else {
 			l.Okf(logPrefix, "Ready to synchronize %s (read-write)", repo.ID)
-			m.StartRepoRW(repo.ID, cfg.Options.ParallelRequests)
+			// Requests are spread over the nodes according to their
+			// request windows; the largest window bounds the total.
+			slots := cfg.Options.MaxRequestWindow
+			if slots < cfg.Options.ParallelRequests {
+				slots = cfg.Options.ParallelRequests
+			}
+			m.StartRepoRW(repo.ID, slots)
 		}
 	}
 
@@ -969,6 +960,12 @@ next:
 			continue
 		}
 
+		if m.NodePaused(remoteID) {
+			l.Infof(logPrefix, "Connection from paused node %s; ignoring", remoteID)
+			conn.Close()
+			continue
+		}
+
 		for _, nodeCfg := range cfg.Nodes {
 			if nodeCfg.NodeID == remoteID {
 				// Verify the name on the certificate. By default we set it to
@@ -1001,7 +998,7 @@ next:
 				}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
-				protoConn := protocol.NewConnection(remoteID, rd, wr, m, name, nodeCfg.Compression)
+				protoConn := protocol.NewConnection(remoteID, rd, wr, m, name, nodeCfg.CompressionOptions())
 
 				l.Infof(logPrefix, "Established secure connection to %s at %s", remoteID, name)
 				if debugNet {
@@ -1072,7 +1069,7 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 				continue
 			}
 
-			if m.ConnectedTo(nodeCfg.NodeID) {
+			if m.ConnectedTo(nodeCfg.NodeID) || m.NodePaused(nodeCfg.NodeID) {
 				continue
 			}
 
@@ -37,14 +37,33 @@ type RepositoryConfiguration struct {
 	Directory       string                        `xml:"directory,attr"`
 	Nodes           []RepositoryNodeConfiguration `xml:"node"`
 	ReadOnly        bool                          `xml:"ro,attr"`
+	ReceiveOnly     bool                          `xml:"receiveOnly,attr"`
 	RescanIntervalS int                           `xml:"rescanIntervalS,attr" default:"60"`
+	Watch           bool                          `xml:"watch,attr"`       // Scan changes as they happen; full scans are then at least an hour apart
+	StableTimeS     int                           `xml:"stableTimeS,attr"` // Hold back files modified less than this long ago
+	InProgress      []string                      `xml:"inProgress"`       // Patterns of files being written, which are never announced
 	IgnorePerms     bool                          `xml:"ignorePerms,attr"`
+	Order           string                        `xml:"order,attr"`
+	MinDiskFreeMiB  int                           `xml:"minDiskFreeMiB,attr"` // Stop pulling when less is free on the disk
+	MaxSizeMiB      int                           `xml:"maxSizeMiB,attr"`     // Stop pulling when the repository would grow larger
+	Paused          bool                          `xml:"paused,attr"`
 	Invalid         string                        `xml:"-"` // Set at runtime when there is an error, not saved
 	Versioning      VersioningConfiguration       `xml:"versioning"`
 
 	nodeIDs []protocol.NodeID
 }
 
+// The orders in which needed files can be pulled. An empty or unknown order
+// means OrderAlphabetic.
+const (
+	OrderRandom        = "random"
+	OrderAlphabetic    = "alphabetic"
+	OrderSmallestFirst = "smallestFirst"
+	OrderLargestFirst  = "largestFirst"
+	OrderOldestFirst   = "oldestFirst"
+	OrderNewestFirst   = "newestFirst"
+)
+
 type VersioningConfiguration struct {
 	Type   string `xml:"type,attr"`
 	Params map[string]string
@@ -101,10 +120,33 @@ type NodeConfiguration struct {
 	Addresses   []string        `xml:"address,omitempty"`
 	Compression bool            `xml:"compression,attr"`
 	CertName    string          `xml:"certName,attr,omitempty"`
+	Paused      bool            `xml:"paused,attr"`
+
+	// Comma separated list of accepted compression codecs, most preferred
+	// first. Empty means LZ4 only. Only used when Compression is set.
+	Codecs           string `xml:"codecs,attr,omitempty"`
+	CompressionLevel int    `xml:"compressionLevel,attr,omitempty"`
+}
+
+// CompressionOptions returns the compression settings to use on connections
+// to the node.
+func (n NodeConfiguration) CompressionOptions() protocol.CompressionOptions {
+	if !n.Compression {
+		return protocol.NoCompression
+	}
+	codecs := protocol.ParseCodecs(n.Codecs)
+	if len(codecs) == 0 {
+		codecs = protocol.DefaultCompression.Codecs
+	}
+	return protocol.CompressionOptions{
+		Codecs: codecs,
+		Level:  n.CompressionLevel,
+	}
 }
 
 type RepositoryNodeConfiguration struct {
-	NodeID protocol.NodeID `xml:"id,attr"`
+	NodeID   protocol.NodeID `xml:"id,attr"`
+	ReadOnly bool            `xml:"readOnly,attr,omitempty"` // the node may receive, but not change, the repository
 
 	Deprecated_Name      string   `xml:"name,attr,omitempty" json:"-"`
 	Deprecated_Addresses []string `xml:"address,omitempty" json:"-"`
@@ -117,7 +159,9 @@ type OptionsConfiguration struct {
 	LocalAnnEnabled    bool     `xml:"localAnnounceEnabled" default:"true"`
 	LocalAnnPort       int      `xml:"localAnnouncePort" default:"21025"`
 	LocalAnnMCAddr     string   `xml:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	ParallelRequests   int      `xml:"parallelRequests" default:"16"`
+	ParallelRequests   int      `xml:"parallelRequests" default:"16"` // initial request window of each node
+	MinRequestWindow   int      `xml:"minRequestWindow" default:"4"`  // the request window adapts to the link between these
+	MaxRequestWindow   int      `xml:"maxRequestWindow" default:"128"`
 	MaxSendKbps        int      `xml:"maxSendKbps"`
 	MaxRecvKbps        int      `xml:"maxRecvKbps"`
 	ReconnectIntervalS int      `xml:"reconnectionIntervalS" default:"60"`
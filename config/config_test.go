@@ -30,6 +30,8 @@ func TestDefaultValues(t *testing.T) {
 		LocalAnnPort:       21025,
 		LocalAnnMCAddr:     "[ff32::5222]:21026",
 		ParallelRequests:   16,
+		MinRequestWindow:   4,
+		MaxRequestWindow:   128,
 		MaxSendKbps:        0,
 		MaxRecvKbps:        0,
 		ReconnectIntervalS: 60,
@@ -101,6 +103,27 @@ func TestNodeConfig(t *testing.T) {
 	}
 }
 
+func TestNodeCompressionOptions(t *testing.T) {
+	n := NodeConfiguration{Compression: false, Codecs: "deflate"}
+	if c := n.CompressionOptions(); len(c.Codecs) != 0 {
+		t.Errorf("Compression should be disabled, not %v", c.Codecs)
+	}
+
+	n = NodeConfiguration{Compression: true}
+	if c := n.CompressionOptions(); !reflect.DeepEqual(c.Codecs, []string{protocol.CodecLZ4}) {
+		t.Errorf("Incorrect default codecs %v", c.Codecs)
+	}
+
+	n = NodeConfiguration{Compression: true, Codecs: "deflate, lz4", CompressionLevel: 9}
+	c := n.CompressionOptions()
+	if !reflect.DeepEqual(c.Codecs, []string{protocol.CodecDeflate, protocol.CodecLZ4}) {
+		t.Errorf("Incorrect codecs %v", c.Codecs)
+	}
+	if c.Level != 9 {
+		t.Errorf("Incorrect level %d", c.Level)
+	}
+}
+
 func TestNoListenAddress(t *testing.T) {
 	cfg, err := Load("testdata/nolistenaddress.xml", node1)
 	if err != nil {
@@ -122,6 +145,8 @@ func TestOverriddenValues(t *testing.T) {
 		LocalAnnPort:       42123,
 		LocalAnnMCAddr:     "quux:3232",
 		ParallelRequests:   32,
+		MinRequestWindow:   8,
+		MaxRequestWindow:   64,
 		MaxSendKbps:        1234,
 		MaxRecvKbps:        2341,
 		ReconnectIntervalS: 6000,
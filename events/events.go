@@ -27,6 +27,9 @@ const (
 	StateChanged
 	RepoRejected
 	ConfigSaved
+	ConflictCreated
+	ItemFailed
+	OutOfSpace
 
 	AllEvents = ^EventType(0)
 )
@@ -59,6 +62,12 @@ func (t EventType) String() string {
 		return "RepoRejected"
 	case ConfigSaved:
 		return "ConfigSaved"
+	case ConflictCreated:
+		return "ConflictCreated"
+	case ItemFailed:
+		return "ItemFailed"
+	case OutOfSpace:
+		return "OutOfSpace"
 	default:
 		return "Unknown"
 	}
@@ -0,0 +1,172 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/syncthing/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The block map records, for each block hash, the local files in all
+// repositories that contain a block with that hash. It is updated with the
+// local files of each Set. Entries may be stale if a file was changed on
+// disk since it was last scanned, so the data must be verified against the
+// hash before use.
+
+func blockKey(hash, repo, name []byte) []byte {
+	k := make([]byte, 1+32+64+len(name))
+	k[0] = keyTypeBlock
+	copy(k[1:], hash)
+	copy(k[1+32:], repo)
+	copy(k[1+32+64:], name)
+	return k
+}
+
+func blockKeyRepo(key []byte) []byte {
+	repo := key[1+32 : 1+32+64]
+	izero := bytes.IndexByte(repo, 0)
+	return repo[:izero]
+}
+
+func blockKeyName(key []byte) []byte {
+	return key[1+32+64:]
+}
+
+// hasBlocks returns true if the file has blocks that are worth recording in
+// the block map.
+func hasBlocks(f protocol.FileInfo) bool {
+	return !f.IsDeleted() && !f.IsInvalid() && !protocol.IsDirectory(f.Flags)
+}
+
+func ldbAddBlocks(batch dbWriter, repo []byte, f protocol.FileInfo) {
+	if !hasBlocks(f) {
+		return
+	}
+	var offset int64
+	for _, b := range f.Blocks {
+		var bs [8]byte
+		binary.BigEndian.PutUint64(bs[:], uint64(offset))
+		batch.Put(blockKey(b.Hash, repo, []byte(f.Name)), bs[:])
+		offset += int64(b.Size)
+	}
+}
+
+func ldbDiscardBlocks(batch dbWriter, repo []byte, f protocol.FileInfo) {
+	for _, b := range f.Blocks {
+		batch.Delete(blockKey(b.Hash, repo, []byte(f.Name)))
+	}
+}
+
+// ldbUpdateBlocks replaces the blocks recorded for the local files in the
+// list with their new blocks. Must be called before the files are updated.
+func ldbUpdateBlocks(db *leveldb.DB, repo []byte, fs []protocol.FileInfo) {
+	batch := new(leveldb.Batch)
+	for _, f := range fs {
+		ef := ldbGet(db, repo, protocol.LocalNodeID[:], []byte(f.Name))
+		if ef.Name == f.Name {
+			ldbDiscardBlocks(batch, repo, ef)
+		}
+		ldbAddBlocks(batch, repo, f)
+	}
+
+	err := db.Write(batch, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ldbResetBlocks records the blocks of all local files in the repository,
+// forgetting any recorded before.
+func ldbResetBlocks(db *leveldb.DB, repo []byte) {
+	batch := new(leveldb.Batch)
+
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+	dbi := snap.NewIterator(&util.Range{Start: []byte{keyTypeBlock}, Limit: []byte{keyTypeBlock + 1}}, nil)
+	defer dbi.Release()
+	for dbi.Next() {
+		if bytes.Equal(blockKeyRepo(dbi.Key()), repo) {
+			batch.Delete(dbi.Key())
+		}
+	}
+
+	ldbWithHave(db, repo, protocol.LocalNodeID[:], false, func(fi protocol.FileIntf) bool {
+		ldbAddBlocks(batch, repo, fi.(protocol.FileInfo))
+		return true
+	})
+
+	err = db.Write(batch, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ldbMigrateBlocks records the blocks of the local files in all
+// repositories.
+func ldbMigrateBlocks(db *leveldb.DB, batch dbWriter) {
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+
+	dbi := snap.NewIterator(&util.Range{Start: []byte{keyTypeNode}, Limit: []byte{keyTypeNode + 1}}, nil)
+	defer dbi.Release()
+	for dbi.Next() {
+		if !bytes.Equal(nodeKeyNode(dbi.Key()), protocol.LocalNodeID[:]) {
+			continue
+		}
+		var f protocol.FileInfo
+		err := f.UnmarshalXDR(dbi.Value())
+		if err != nil {
+			panic(err)
+		}
+		ldbAddBlocks(batch, nodeKeyRepo(dbi.Key()), f)
+	}
+}
+
+// A BlockFinder looks up blocks in the local files of all repositories.
+type BlockFinder struct {
+	db *leveldb.DB
+}
+
+func NewBlockFinder(db *leveldb.DB) *BlockFinder {
+	return &BlockFinder{db: db}
+}
+
+// Iterate calls fn with the repository, file name and offset of each known
+// local copy of the block with the given hash, until fn returns true.
+// Returns true if fn did, i.e. if a usable copy was found.
+func (f *BlockFinder) Iterate(hash []byte, fn func(repo, name string, offset int64) bool) bool {
+	prefix := blockKey(hash, nil, nil)[:1+32] // all repo/files for the hash
+
+	snap, err := f.db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+	dbi := snap.NewIterator(util.BytesPrefix(prefix), nil)
+	defer dbi.Release()
+
+	for dbi.Next() {
+		if len(dbi.Value()) != 8 {
+			continue
+		}
+		repo := string(blockKeyRepo(dbi.Key()))
+		name := string(blockKeyName(dbi.Key()))
+		offset := int64(binary.BigEndian.Uint64(dbi.Value()))
+		if fn(repo, nativeFilename(name), offset) {
+			return true
+		}
+	}
+	return false
+}
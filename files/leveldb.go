@@ -6,6 +6,7 @@ package files
 
 import (
 	"bytes"
+	"encoding/binary"
 	"runtime"
 	"sort"
 	"sync"
@@ -37,10 +38,19 @@ func clock(v uint64) uint64 {
 const (
 	keyTypeNode = iota
 	keyTypeGlobal
+	keyTypeSynced
+	keyTypeSchema
+	keyTypeBlock
+	keyTypeIndexID
 )
 
+// The version of the database layout. Version 1 adds version vectors to the
+// stored files and the global version lists. Version 2 adds the block map.
+const schemaVersion = 2
+
 type fileVersion struct {
 	version uint64
+	vector  []byte // XDR encoded protocol.Vector
 	node    []byte
 }
 
@@ -48,6 +58,98 @@ type versionList struct {
 	versions []fileVersion
 }
 
+// The fileVersion and versionList structures as stored in schema version 0,
+// without version vectors
+type fileVersionV0 struct {
+	version uint64
+	node    []byte
+}
+
+type versionListV0 struct {
+	versions []fileVersionV0
+}
+
+func newFileVersion(node []byte, version uint64, vector protocol.Vector) fileVersion {
+	return fileVersion{
+		version: version,
+		vector:  vector.MarshalXDR(),
+		node:    node,
+	}
+}
+
+func (v fileVersion) decodedVector() protocol.Vector {
+	var vec protocol.Vector
+	if err := vec.UnmarshalXDR(v.vector); err != nil {
+		panic(err)
+	}
+	return vec
+}
+
+// precedes breaks the tie between two versions that neither dominates the
+// other, because they are concurrent or either was last changed by a node
+// that predates version vectors. The higher lamport version comes first,
+// then the greater vector, so that all nodes agree on the winner whichever
+// of them is local. Equal versions are ordered on the node ID.
+func (v fileVersion) precedes(b fileVersion) bool {
+	if v.version != b.version {
+		return v.version > b.version
+	}
+	if c := bytes.Compare(v.vector, b.vector); c != 0 {
+		return c > 0
+	}
+	return bytes.Compare(v.node, b.node) > 0
+}
+
+// sortVersions orders the versions newest first. A version comes after every
+// version whose vector dominates its own; apart from that the order is the
+// one given by precedes. As the dominance of vectors and the order of
+// lamport versions may disagree for files changed by legacy nodes, this is
+// done by repeatedly picking the preceding one of the versions that no
+// remaining version dominates. The result depends only on the versions in
+// the list, not on the order in which they were added.
+func sortVersions(vs []fileVersion) {
+	vecs := make([]protocol.Vector, len(vs))
+	for i := range vs {
+		vecs[i] = vs[i].decodedVector()
+	}
+	dominated := func(j, from int) bool {
+		if vecs[j].IsEmpty() {
+			return false
+		}
+		for k := from; k < len(vs); k++ {
+			if k != j && !vecs[k].IsEmpty() && vecs[k].Compare(vecs[j]) == protocol.Greater {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := range vs {
+		best := -1
+		for j := i; j < len(vs); j++ {
+			if dominated(j, i) {
+				continue
+			}
+			if best < 0 || vs[j].precedes(vs[best]) {
+				best = j
+			}
+		}
+		vs[i], vs[best] = vs[best], vs[i]
+		vecs[i], vecs[best] = vecs[best], vecs[i]
+	}
+}
+
+// equal returns true if the two are the same version of the file.
+func (v fileVersion) equal(b fileVersion) bool {
+	return v.version == b.version && v.decodedVector().Equal(b.decodedVector())
+}
+
+// sameVersion returns true if the two files are the same version, i.e. if
+// storing f over ef does not change anything but possibly the flags.
+func sameVersion(f protocol.FileInfo, ef protocol.FileInfoTruncated) bool {
+	return f.Version == ef.Version && f.Vector.Equal(ef.Vector)
+}
+
 type fileList []protocol.FileInfo
 
 func (l fileList) Len() int {
@@ -86,6 +188,29 @@ keyTypeGlobal (1 byte)
 			|
 			[]fileVersion (sorted)
 
+keyTypeSynced (1 byte)
+	repository (64 bytes)
+		name (variable size)
+			|
+			version (8 bytes); the last local version also seen on another node
+
+keyTypeSchema (1 byte)
+	|
+	schema version (4 bytes)
+
+keyTypeBlock (1 byte)
+	hash (32 bytes)
+		repository (64 bytes)
+			name (variable size)
+				|
+				offset (8 bytes); where the block is in the local file
+
+keyTypeIndexID (1 byte)
+	repository (64 bytes)
+		node (32 bytes)
+			|
+			index ID (8 bytes); identifies the index the node's files come from
+
 */
 
 func nodeKey(repo, node, file []byte) []byte {
@@ -105,6 +230,22 @@ func globalKey(repo, file []byte) []byte {
 	return k
 }
 
+func syncedKey(repo, file []byte) []byte {
+	k := make([]byte, 1+64+len(file))
+	k[0] = keyTypeSynced
+	copy(k[1:], []byte(repo))
+	copy(k[1+64:], []byte(file))
+	return k
+}
+
+func indexIDKey(repo, node []byte) []byte {
+	k := make([]byte, 1+64+32)
+	k[0] = keyTypeIndexID
+	copy(k[1:], []byte(repo))
+	copy(k[1+64:], node[:])
+	return k
+}
+
 func nodeKeyName(key []byte) []byte {
 	return key[1+64+32:]
 }
@@ -189,7 +330,7 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo
 			if fs[fsi].IsInvalid() {
 				ldbRemoveFromGlobal(snap, batch, repo, node, newName)
 			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
+				ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version, fs[fsi].Vector)
 			}
 			fsi++
 
@@ -199,15 +340,19 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo
 			// marked a file as invalid, so handle that too.
 			var ef protocol.FileInfoTruncated
 			ef.UnmarshalXDR(dbi.Value())
-			if fs[fsi].Version > ef.Version || fs[fsi].Version != ef.Version {
+			if !sameVersion(fs[fsi], ef) {
 				if lv := ldbInsert(batch, repo, node, newName, fs[fsi]); lv > maxLocalVer {
 					maxLocalVer = lv
 				}
 				if fs[fsi].IsInvalid() {
 					ldbRemoveFromGlobal(snap, batch, repo, node, newName)
 				} else {
-					ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version)
+					ldbUpdateGlobal(snap, batch, repo, node, newName, fs[fsi].Version, fs[fsi].Vector)
 				}
+			} else if ef.LocalVersion > maxLocalVer {
+				// The file is unchanged but still counts towards the
+				// highest local version present for the node.
+				maxLocalVer = ef.LocalVersion
 			}
 			// Iterate both sides.
 			fsi++
@@ -232,7 +377,6 @@ func ldbGenericReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo
 }
 
 func ldbReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64 {
-	// TODO: Return the remaining maxLocalVer?
 	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) uint64 {
 		// Disk has files that we are missing. Remove it.
 		if debug {
@@ -244,7 +388,7 @@ func ldbReplace(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint6
 	})
 }
 
-func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64 {
+func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo, myID uint64) uint64 {
 	return ldbGenericReplace(db, repo, node, fs, func(db dbReader, batch dbWriter, repo, node, name []byte, dbi iterator.Iterator) uint64 {
 		var tf protocol.FileInfoTruncated
 		err := tf.UnmarshalXDR(dbi.Value())
@@ -260,11 +404,12 @@ func ldbReplaceWithDelete(db *leveldb.DB, repo, node []byte, fs []protocol.FileI
 				Name:         tf.Name,
 				Version:      lamport.Default.Tick(tf.Version),
 				LocalVersion: ts,
+				Vector:       tf.Vector.Update(myID),
 				Flags:        tf.Flags | protocol.FlagDeleted,
 				Modified:     tf.Modified,
 			}
 			batch.Put(dbi.Key(), f.MarshalXDR())
-			ldbUpdateGlobal(db, batch, repo, node, nodeKeyName(dbi.Key()), f.Version)
+			ldbUpdateGlobal(db, batch, repo, node, nodeKeyName(dbi.Key()), f.Version, f.Vector)
 			return ts
 		}
 		return 0
@@ -293,7 +438,7 @@ func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64
 			if f.IsInvalid() {
 				ldbRemoveFromGlobal(snap, batch, repo, node, name)
 			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
+				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version, f.Vector)
 			}
 			continue
 		}
@@ -305,14 +450,14 @@ func ldbUpdate(db *leveldb.DB, repo, node []byte, fs []protocol.FileInfo) uint64
 		}
 		// Flags might change without the version being bumped when we set the
 		// invalid flag on an existing file.
-		if ef.Version != f.Version || ef.Flags != f.Flags {
+		if !sameVersion(f, ef) || ef.Flags != f.Flags {
 			if lv := ldbInsert(batch, repo, node, name, f); lv > maxLocalVer {
 				maxLocalVer = lv
 			}
 			if f.IsInvalid() {
 				ldbRemoveFromGlobal(snap, batch, repo, node, name)
 			} else {
-				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version)
+				ldbUpdateGlobal(snap, batch, repo, node, name, f.Version, f.Vector)
 			}
 		}
 	}
@@ -343,9 +488,9 @@ func ldbInsert(batch dbWriter, repo, node, name []byte, file protocol.FileInfo)
 // ldbUpdateGlobal adds this node+version to the version list for the given
 // file. If the node is already present in the list, the version is updated.
 // If the file does not have an entry in the global list, it is created.
-func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, version uint64) bool {
+func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, version uint64, vector protocol.Vector) bool {
 	if debug {
-		l.Debugf(logPrefix, "update global; repo=%q node=%v file=%q version=%d", repo, protocol.NodeIDFromBytes(node), file, version)
+		l.Debugf(logPrefix, "update global; repo=%q node=%v file=%q version=%d vector=%v", repo, protocol.NodeIDFromBytes(node), file, version, vector)
 	}
 	gk := globalKey(repo, file)
 	svl, err := db.Get(gk, nil)
@@ -354,10 +499,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, versi
 	}
 
 	var fl versionList
-	nv := fileVersion{
-		node:    node,
-		version: version,
-	}
+	nv := newFileVersion(node, version, vector)
 	if svl != nil {
 		err = fl.UnmarshalXDR(svl)
 		if err != nil {
@@ -366,7 +508,7 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, versi
 
 		for i := range fl.versions {
 			if bytes.Compare(fl.versions[i].node, node) == 0 {
-				if fl.versions[i].version == version {
+				if fl.versions[i].equal(nv) {
 					// No need to do anything
 					return false
 				}
@@ -376,24 +518,206 @@ func ldbUpdateGlobal(db dbReader, batch dbWriter, repo, node, file []byte, versi
 		}
 	}
 
-	for i := range fl.versions {
-		if fl.versions[i].version <= version {
-			t := append(fl.versions, fileVersion{})
-			copy(t[i+1:], t[i:])
-			t[i] = nv
-			fl.versions = t
-			goto done
-		}
-	}
-
 	fl.versions = append(fl.versions, nv)
+	sortVersions(fl.versions)
 
-done:
 	batch.Put(gk, fl.MarshalXDR())
+	ldbUpdateSynced(batch, repo, file, fl)
 
 	return true
 }
 
+// ldbUpdateSynced records the local version of the file as synced if some
+// other node has the same version, i.e. if we have pulled it from another
+// node or another node has pulled it from us.
+func ldbUpdateSynced(batch dbWriter, repo, file []byte, fl versionList) {
+	local, ok := localVersion(fl)
+	if !ok {
+		return
+	}
+	for _, v := range fl.versions {
+		if v.equal(local) && !bytes.Equal(v.node, protocol.LocalNodeID[:]) {
+			var bs [8]byte
+			binary.BigEndian.PutUint64(bs[:], local.version)
+			batch.Put(syncedKey(repo, file), bs[:])
+			return
+		}
+	}
+}
+
+func localVersion(fl versionList) (fileVersion, bool) {
+	for _, v := range fl.versions {
+		if bytes.Equal(v.node, protocol.LocalNodeID[:]) {
+			return v, true
+		}
+	}
+	return fileVersion{}, false
+}
+
+// ldbLocallyChanged returns true if the local version of the file has not
+// been seen on any other node, i.e. if it contains changes made here since
+// the file was last synced.
+func ldbLocallyChanged(db dbReader, repo, file []byte) bool {
+	bs, err := db.Get(globalKey(repo, file), nil)
+	if err == leveldb.ErrNotFound {
+		return false
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	var fl versionList
+	err = fl.UnmarshalXDR(bs)
+	if err != nil {
+		panic(err)
+	}
+
+	local, ok := localVersion(fl)
+	if !ok {
+		return false
+	}
+
+	var synced uint64
+	bs, err = db.Get(syncedKey(repo, file), nil)
+	if err == nil && len(bs) == 8 {
+		synced = binary.BigEndian.Uint64(bs)
+	} else if err != nil && err != leveldb.ErrNotFound {
+		panic(err)
+	}
+
+	return local.version != synced
+}
+
+// ldbIndexID returns the index ID stored for the node, or zero if there is
+// none.
+func ldbIndexID(db dbReader, repo, node []byte) uint64 {
+	bs, err := db.Get(indexIDKey(repo, node), nil)
+	if err == leveldb.ErrNotFound {
+		return 0
+	}
+	if err != nil {
+		panic(err)
+	}
+	if len(bs) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(bs)
+}
+
+func ldbSetIndexID(db *leveldb.DB, repo, node []byte, id uint64) {
+	var bs [8]byte
+	binary.BigEndian.PutUint64(bs[:], id)
+	if err := db.Put(indexIDKey(repo, node), bs[:], nil); err != nil {
+		panic(err)
+	}
+}
+
+// ldbInitSynced assumes that all local files are in sync, unless synced
+// versions have been tracked for the repo before. This keeps files that
+// predate the tracking from being seen as changed locally.
+func ldbInitSynced(db *leveldb.DB, repo []byte) {
+	marker := syncedKey(repo, nil)
+	if _, err := db.Get(marker, nil); err == nil {
+		return
+	} else if err != leveldb.ErrNotFound {
+		panic(err)
+	}
+
+	batch := new(leveldb.Batch)
+	ldbWithHave(db, repo, protocol.LocalNodeID[:], true, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfoTruncated)
+		var bs [8]byte
+		binary.BigEndian.PutUint64(bs[:], f.Version)
+		batch.Put(syncedKey(repo, []byte(f.Name)), bs[:])
+		return true
+	})
+	batch.Put(marker, nil)
+
+	err := db.Write(batch, nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+var migrateMut sync.Mutex
+
+// ldbMigrate converts a database written with an older schema version to
+// the current one, one version at a time.
+func ldbMigrate(db *leveldb.DB) {
+	migrateMut.Lock()
+	defer migrateMut.Unlock()
+
+	var ver uint32
+	bs, err := db.Get([]byte{keyTypeSchema}, nil)
+	if err == nil && len(bs) == 4 {
+		ver = binary.BigEndian.Uint32(bs)
+	} else if err != nil && err != leveldb.ErrNotFound {
+		panic(err)
+	}
+
+	for ; ver < schemaVersion; ver++ {
+		if debug {
+			l.Debugf(logPrefix, "migrating database to schema version %d", ver+1)
+		}
+
+		batch := new(leveldb.Batch)
+		switch ver {
+		case 0:
+			ldbMigrateVectors(db, batch)
+		case 1:
+			ldbMigrateBlocks(db, batch)
+		}
+
+		var bs [4]byte
+		binary.BigEndian.PutUint32(bs[:], ver+1)
+		batch.Put([]byte{keyTypeSchema}, bs[:])
+
+		err = db.Write(batch, nil)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// ldbMigrateVectors converts the stored files and global version lists to
+// the format with version vectors. Files stored before version vectors were
+// introduced get empty vectors, so their order is still decided by the
+// lamport versions.
+func ldbMigrateVectors(db *leveldb.DB, batch dbWriter) {
+	snap, err := db.GetSnapshot()
+	if err != nil {
+		panic(err)
+	}
+	defer snap.Release()
+
+	dbi := snap.NewIterator(&util.Range{Start: []byte{keyTypeNode}, Limit: []byte{keyTypeNode + 1}}, nil)
+	for dbi.Next() {
+		var f protocol.FileInfo
+		err := f.UnmarshalXDRV0(dbi.Value())
+		if err != nil {
+			panic(err)
+		}
+		batch.Put(dbi.Key(), f.MarshalXDR())
+	}
+	dbi.Release()
+
+	var empty = protocol.Vector{}.MarshalXDR()
+	dbi = snap.NewIterator(&util.Range{Start: []byte{keyTypeGlobal}, Limit: []byte{keyTypeGlobal + 1}}, nil)
+	for dbi.Next() {
+		var vl0 versionListV0
+		err := vl0.UnmarshalXDR(dbi.Value())
+		if err != nil {
+			panic(err)
+		}
+		var vl versionList
+		for _, v := range vl0.versions {
+			vl.versions = append(vl.versions, fileVersion{v.version, empty, v.node})
+		}
+		batch.Put(dbi.Key(), vl.MarshalXDR())
+	}
+	dbi.Release()
+}
+
 // ldbRemoveFromGlobal removes the node from the global version list for the
 // given file. If the version list is empty after this, the file entry is
 // removed entirely.
@@ -594,7 +918,7 @@ func ldbAvailability(db *leveldb.DB, repo, file []byte) []protocol.NodeID {
 
 	var nodes []protocol.NodeID
 	for _, v := range vl.versions {
-		if v.version != vl.versions[0].version {
+		if !v.equal(vl.versions[0]) {
 			break
 		}
 		n := protocol.NodeIDFromBytes(v.node)
@@ -636,17 +960,17 @@ outer:
 			if bytes.Compare(v.node, node) == 0 {
 				have = true
 				haveVersion = v.version
-				need = v.version < vl.versions[0].version
+				need = !v.equal(vl.versions[0])
 				break
 			}
 		}
 
 		if need || !have {
 			name := globalKeyName(dbi.Key())
-			needVersion := vl.versions[0].version
+			needVersion := vl.versions[0]
 		inner:
 			for i := range vl.versions {
-				if vl.versions[i].version != needVersion {
+				if !vl.versions[i].equal(needVersion) {
 					// We haven't found a valid copy of the file with the needed version.
 					continue outer
 				}
@@ -748,6 +1072,44 @@ func ldbDropRepo(db *leveldb.DB, repo []byte) {
 		}
 	}
 	dbi.Release()
+
+	// Remove all synced versions for the given repo. The key layout is the
+	// same as for the global bucket.
+	start = []byte{keyTypeSynced}
+	limit = []byte{keyTypeSynced + 1}
+	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	for dbi.Next() {
+		itemRepo := globalKeyRepo(dbi.Key())
+		if bytes.Compare(repo, itemRepo) == 0 {
+			db.Delete(dbi.Key(), nil)
+		}
+	}
+	dbi.Release()
+
+	// Remove the index IDs of the given repo. The key layout is the same as
+	// for the node->file bucket, without the name.
+	start = []byte{keyTypeIndexID}
+	limit = []byte{keyTypeIndexID + 1}
+	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	for dbi.Next() {
+		itemRepo := nodeKeyRepo(dbi.Key())
+		if bytes.Compare(repo, itemRepo) == 0 {
+			db.Delete(dbi.Key(), nil)
+		}
+	}
+	dbi.Release()
+
+	// Remove all blocks of the given repo from the block map
+	start = []byte{keyTypeBlock}
+	limit = []byte{keyTypeBlock + 1}
+	dbi = snap.NewIterator(&util.Range{Start: start, Limit: limit}, nil)
+	for dbi.Next() {
+		itemRepo := blockKeyRepo(dbi.Key())
+		if bytes.Compare(repo, itemRepo) == 0 {
+			db.Delete(dbi.Key(), nil)
+		}
+	}
+	dbi.Release()
 }
 
 func unmarshalTrunc(bs []byte, truncate bool) (protocol.FileIntf, error) {
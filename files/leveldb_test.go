@@ -0,0 +1,87 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package files
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/calmh/xdr"
+	"github.com/syncthing/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestMigrateSchema0(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file and its global version list as stored before version vectors
+	repo, name := []byte("test"), []byte("a")
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	xw.WriteString("a")
+	xw.WriteUint32(0)    // flags
+	xw.WriteUint64(0)    // modified
+	xw.WriteUint64(1000) // version
+	xw.WriteUint64(1)    // local version
+	xw.WriteUint32(0)    // no blocks
+	db.Put(nodeKey(repo, protocol.LocalNodeID[:], name), buf.Bytes(), nil)
+	vl := versionListV0{[]fileVersionV0{{1000, protocol.LocalNodeID[:]}}}
+	db.Put(globalKey(repo, name), vl.MarshalXDR(), nil)
+
+	s := NewSet("test", db)
+
+	f := s.Get(protocol.LocalNodeID, "a")
+	if f.Name != "a" || f.Version != 1000 || !f.Vector.IsEmpty() {
+		t.Errorf("Incorrect migrated file %v", f)
+	}
+	if g := s.GetGlobal("a"); g.Name != "a" || g.Version != 1000 {
+		t.Errorf("Incorrect migrated global file %v", g)
+	}
+
+	// The file can be updated as usual
+	s.Update(protocol.LocalNodeID, []protocol.FileInfo{{Name: "a", Version: 1001, Vector: protocol.Vector{}.Update(1)}})
+	if g := s.GetGlobal("a"); g.Version != 1001 || g.Vector.Counter(1) != 1 {
+		t.Errorf("Incorrect updated global file %v", g)
+	}
+
+	// Migration happens only once
+	NewSet("test", db)
+	if g := s.GetGlobal("a"); g.Version != 1001 {
+		t.Errorf("Incorrect global file after reopening %v", g)
+	}
+}
+
+func TestSortVersionsMixed(t *testing.T) {
+	vec := func(ids ...uint64) protocol.Vector {
+		var v protocol.Vector
+		for _, id := range ids {
+			v = v.Update(id)
+		}
+		return v
+	}
+
+	// c dominates b despite the lower lamport version, while a predates
+	// version vectors. Ordered pairwise, the three form a cycle.
+	a := newFileVersion([]byte("a"), 8, protocol.Vector{})
+	b := newFileVersion([]byte("b"), 9, vec(1))
+	c := newFileVersion([]byte("c"), 7, vec(1, 2))
+	expected := "acb"
+
+	for _, perm := range [][]fileVersion{{a, b, c}, {a, c, b}, {b, a, c}, {b, c, a}, {c, a, b}, {c, b, a}} {
+		vs := append([]fileVersion(nil), perm...)
+		sortVersions(vs)
+		var order string
+		for _, v := range vs {
+			order += string(v.node)
+		}
+		if order != expected {
+			t.Errorf("Incorrect order %q != %q when sorting %q%q%q", order, expected, perm[0].node, perm[1].node, perm[2].node)
+		}
+	}
+}
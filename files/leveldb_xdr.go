@@ -22,6 +22,12 @@ fileVersion Structure:
 +                       version (64 bits)                       +
 |                                                               |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                       Length of vector                        |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                   vector (variable length)                    \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 |                        Length of node                         |
 +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 /                                                               /
@@ -32,6 +38,7 @@ fileVersion Structure:
 
 struct fileVersion {
 	unsigned hyper version;
+	opaque vector<>;
 	opaque node<>;
 }
 
@@ -55,6 +62,7 @@ func (o fileVersion) AppendXDR(bs []byte) []byte {
 
 func (o fileVersion) encodeXDR(xw *xdr.Writer) (int, error) {
 	xw.WriteUint64(o.version)
+	xw.WriteBytes(o.vector)
 	xw.WriteBytes(o.node)
 	return xw.Tot(), xw.Error()
 }
@@ -72,6 +80,7 @@ func (o *fileVersion) UnmarshalXDR(bs []byte) error {
 
 func (o *fileVersion) decodeXDR(xr *xdr.Reader) error {
 	o.version = xr.ReadUint64()
+	o.vector = xr.ReadBytes()
 	o.node = xr.ReadBytes()
 	return xr.Error()
 }
@@ -143,3 +152,136 @@ func (o *versionList) decodeXDR(xr *xdr.Reader) error {
 	}
 	return xr.Error()
 }
+
+/*
+
+fileVersionV0 Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                                                               |
++                       version (64 bits)                       +
+|                                                               |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                        Length of node                         |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\                    node (variable length)                     \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct fileVersionV0 {
+	unsigned hyper version;
+	opaque node<>;
+}
+
+*/
+
+func (o fileVersionV0) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o fileVersionV0) MarshalXDR() []byte {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o fileVersionV0) AppendXDR(bs []byte) []byte {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	o.encodeXDR(xw)
+	return []byte(aw)
+}
+
+func (o fileVersionV0) encodeXDR(xw *xdr.Writer) (int, error) {
+	xw.WriteUint64(o.version)
+	xw.WriteBytes(o.node)
+	return xw.Tot(), xw.Error()
+}
+
+func (o *fileVersionV0) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *fileVersionV0) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *fileVersionV0) decodeXDR(xr *xdr.Reader) error {
+	o.version = xr.ReadUint64()
+	o.node = xr.ReadBytes()
+	return xr.Error()
+}
+
+/*
+
+versionListV0 Structure:
+
+ 0                   1                   2                   3
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+|                      Number of versions                       |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+/                                                               /
+\             Zero or more fileVersionV0 Structures             \
+/                                                               /
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+
+struct versionListV0 {
+	fileVersionV0 versions<>;
+}
+
+*/
+
+func (o versionListV0) EncodeXDR(w io.Writer) (int, error) {
+	var xw = xdr.NewWriter(w)
+	return o.encodeXDR(xw)
+}
+
+func (o versionListV0) MarshalXDR() []byte {
+	return o.AppendXDR(make([]byte, 0, 128))
+}
+
+func (o versionListV0) AppendXDR(bs []byte) []byte {
+	var aw = xdr.AppendWriter(bs)
+	var xw = xdr.NewWriter(&aw)
+	o.encodeXDR(xw)
+	return []byte(aw)
+}
+
+func (o versionListV0) encodeXDR(xw *xdr.Writer) (int, error) {
+	xw.WriteUint32(uint32(len(o.versions)))
+	for i := range o.versions {
+		_, err := o.versions[i].encodeXDR(xw)
+		if err != nil {
+			return xw.Tot(), err
+		}
+	}
+	return xw.Tot(), xw.Error()
+}
+
+func (o *versionListV0) DecodeXDR(r io.Reader) error {
+	xr := xdr.NewReader(r)
+	return o.decodeXDR(xr)
+}
+
+func (o *versionListV0) UnmarshalXDR(bs []byte) error {
+	var br = bytes.NewReader(bs)
+	var xr = xdr.NewReader(br)
+	return o.decodeXDR(xr)
+}
+
+func (o *versionListV0) decodeXDR(xr *xdr.Reader) error {
+	_versionsSize := int(xr.ReadUint32())
+	o.versions = make([]fileVersionV0, _versionsSize)
+	for i := range o.versions {
+		(&o.versions[i]).decodeXDR(xr)
+	}
+	return xr.Error()
+}
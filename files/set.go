@@ -11,6 +11,8 @@
 package files
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"sync"
 
 	"github.com/syncthing/syncthing/lamport"
@@ -40,6 +42,8 @@ func NewSet(repo string, db *leveldb.DB) *Set {
 		db:           db,
 	}
 
+	ldbMigrate(db)
+
 	var nodeID protocol.NodeID
 	ldbWithAllRepoTruncated(db, []byte(repo), func(node []byte, f protocol.FileInfoTruncated) bool {
 		copy(nodeID[:], node)
@@ -53,10 +57,27 @@ func NewSet(repo string, db *leveldb.DB) *Set {
 		l.Debugf("loaded localVersion for %q: %#v", repo, s.localVersion)
 	}
 	clock(s.localVersion[protocol.LocalNodeID])
+	ldbInitSynced(db, []byte(repo))
+	if ldbIndexID(db, []byte(repo), protocol.LocalNodeID[:]) == 0 {
+		ldbSetIndexID(db, []byte(repo), protocol.LocalNodeID[:], newIndexID())
+	}
 
 	return &s
 }
 
+// newIndexID returns a random, nonzero index ID.
+func newIndexID() uint64 {
+	var bs [8]byte
+	for {
+		if _, err := rand.Read(bs[:]); err != nil {
+			panic(err)
+		}
+		if id := binary.BigEndian.Uint64(bs[:]); id != 0 {
+			return id
+		}
+	}
+}
+
 func (s *Set) Replace(node protocol.NodeID, fs []protocol.FileInfo) {
 	if debug {
 		l.Debugf("%s Replace(%v, [%d])", s.repo, node, len(fs))
@@ -67,16 +88,23 @@ func (s *Set) Replace(node protocol.NodeID, fs []protocol.FileInfo) {
 	s.localVersion[node] = ldbReplace(s.db, []byte(s.repo), node[:], fs)
 }
 
-func (s *Set) ReplaceWithDelete(node protocol.NodeID, fs []protocol.FileInfo) {
+// ReplaceWithDelete replaces the files of the node like Replace, but marks
+// files that are missing from the list as deleted instead of forgetting them.
+// The version vectors of deleted files are updated with myID, the short ID
+// of the local node.
+func (s *Set) ReplaceWithDelete(node protocol.NodeID, fs []protocol.FileInfo, myID uint64) {
 	if debug {
 		l.Debugf("%s ReplaceWithDelete(%v, [%d])", s.repo, node, len(fs))
 	}
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	if lv := ldbReplaceWithDelete(s.db, []byte(s.repo), node[:], fs); lv > s.localVersion[node] {
+	if lv := ldbReplaceWithDelete(s.db, []byte(s.repo), node[:], fs, myID); lv > s.localVersion[node] {
 		s.localVersion[node] = lv
 	}
+	if node == protocol.LocalNodeID {
+		ldbResetBlocks(s.db, []byte(s.repo))
+	}
 }
 
 func (s *Set) Update(node protocol.NodeID, fs []protocol.FileInfo) {
@@ -86,6 +114,9 @@ func (s *Set) Update(node protocol.NodeID, fs []protocol.FileInfo) {
 	normalizeFilenames(fs)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if node == protocol.LocalNodeID {
+		ldbUpdateBlocks(s.db, []byte(s.repo), fs)
+	}
 	if lv := ldbUpdate(s.db, []byte(s.repo), node[:], fs); lv > s.localVersion[node] {
 		s.localVersion[node] = lv
 	}
@@ -149,12 +180,36 @@ func (s *Set) Availability(file string) []protocol.NodeID {
 	return ldbAvailability(s.db, []byte(s.repo), []byte(normalizedFilename(file)))
 }
 
+// LocallyChanged returns true if the local version of the file has been
+// changed since it was last synced with another node, i.e. if some other
+// node changing the file too would be a conflict.
+func (s *Set) LocallyChanged(file string) bool {
+	return ldbLocallyChanged(s.db, []byte(s.repo), []byte(normalizedFilename(file)))
+}
+
 func (s *Set) LocalVersion(node protocol.NodeID) uint64 {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 	return s.localVersion[node]
 }
 
+// IndexID returns the ID of the index that the node's files in the set come
+// from, or zero if it is unknown. The local index is given a random ID when
+// the set is first created, so that a peer can tell it apart from the index
+// it had before our database was reset.
+func (s *Set) IndexID(node protocol.NodeID) uint64 {
+	return ldbIndexID(s.db, []byte(s.repo), node[:])
+}
+
+// SetIndexID records the ID of the index that the node's files in the set
+// come from.
+func (s *Set) SetIndexID(node protocol.NodeID, id uint64) {
+	if debug {
+		l.Debugf("%s SetIndexID(%v, %x)", s.repo, node, id)
+	}
+	ldbSetIndexID(s.db, []byte(s.repo), node[:], id)
+}
+
 // ListRepos returns the repository IDs seen in the database.
 func ListRepos(db *leveldb.DB) []string {
 	return ldbListRepos(db)
@@ -158,8 +158,8 @@ func TestGlobalSet(t *testing.T) {
 		local0[3],
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local0)
-	m.ReplaceWithDelete(protocol.LocalNodeID, local1)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local0, 0)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local1, 0)
 	m.Replace(remoteNode0, remote0)
 	m.Update(remoteNode0, remote1)
 
@@ -268,7 +268,7 @@ func TestNeedWithInvalid(t *testing.T) {
 		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(7)},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalNodeID, localHave)
+	s.ReplaceWithDelete(protocol.LocalNodeID, localHave, 0)
 	s.Replace(remoteNode0, remote0Have)
 	s.Replace(remoteNode1, remote1Have)
 
@@ -297,7 +297,7 @@ func TestUpdateToInvalid(t *testing.T) {
 		protocol.FileInfo{Name: "d", Version: 1003, Blocks: genBlocks(7)},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalNodeID, localHave)
+	s.ReplaceWithDelete(protocol.LocalNodeID, localHave, 0)
 
 	have := fileList(haveList(s, protocol.LocalNodeID))
 	sort.Sort(have)
@@ -376,7 +376,7 @@ func TestLocalDeleted(t *testing.T) {
 		protocol.FileInfo{Name: "z", Version: 1000, Flags: protocol.FlagDirectory},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local1)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local1, 0)
 
 	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
 		local1[0],
@@ -384,25 +384,27 @@ func TestLocalDeleted(t *testing.T) {
 		local1[2],
 		local1[3],
 		local1[4],
-	})
+	}, 0)
 	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
 		local1[0],
 		local1[2],
 		// [3] removed
 		local1[4],
-	})
+	}, 0)
 	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
 		local1[0],
 		local1[2],
 		// [4] removed
-	})
+	}, 0)
+
+	deleted := protocol.Vector{Counters: []protocol.Counter{{ID: 0, Value: 1}}}
 
 	expectedGlobal1 := []protocol.FileInfo{
 		local1[0],
-		protocol.FileInfo{Name: "b", Version: 1001, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "b", Version: 1001, Vector: deleted, Flags: protocol.FlagDeleted},
 		local1[2],
-		protocol.FileInfo{Name: "d", Version: 1002, Flags: protocol.FlagDeleted},
-		protocol.FileInfo{Name: "z", Version: 1003, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
+		protocol.FileInfo{Name: "d", Version: 1002, Vector: deleted, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "z", Version: 1003, Vector: deleted, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
 	}
 
 	g := globalList(m)
@@ -416,14 +418,14 @@ func TestLocalDeleted(t *testing.T) {
 	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
 		local1[0],
 		// [2] removed
-	})
+	}, 0)
 
 	expectedGlobal2 := []protocol.FileInfo{
 		local1[0],
-		protocol.FileInfo{Name: "b", Version: 1001, Flags: protocol.FlagDeleted},
-		protocol.FileInfo{Name: "c", Version: 1004, Flags: protocol.FlagDeleted},
-		protocol.FileInfo{Name: "d", Version: 1002, Flags: protocol.FlagDeleted},
-		protocol.FileInfo{Name: "z", Version: 1003, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
+		protocol.FileInfo{Name: "b", Version: 1001, Vector: deleted, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "c", Version: 1004, Vector: deleted, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "d", Version: 1002, Vector: deleted, Flags: protocol.FlagDeleted},
+		protocol.FileInfo{Name: "z", Version: 1003, Vector: deleted, Flags: protocol.FlagDeleted | protocol.FlagDirectory},
 	}
 
 	g = globalList(m)
@@ -449,7 +451,7 @@ func Benchmark10kReplace(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		m := files.NewSet("test", db)
-		m.ReplaceWithDelete(protocol.LocalNodeID, local)
+		m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 	}
 }
 
@@ -472,7 +474,7 @@ func Benchmark10kUpdateChg(b *testing.B) {
 		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -503,7 +505,7 @@ func Benchmark10kUpdateSme(b *testing.B) {
 		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 1000})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -533,7 +535,7 @@ func Benchmark10kNeed2k(b *testing.B) {
 		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -566,7 +568,7 @@ func Benchmark10kHaveFullList(b *testing.B) {
 		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -599,7 +601,7 @@ func Benchmark10kGlobal(b *testing.B) {
 		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("file%d", i), Version: 980})
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -632,7 +634,7 @@ func TestGlobalReset(t *testing.T) {
 		protocol.FileInfo{Name: "e", Version: 1000},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 	g := globalList(m)
 	sort.Sort(fileList(g))
 
@@ -679,7 +681,7 @@ func TestNeed(t *testing.T) {
 		protocol.FileInfo{Name: "e", Version: 1000},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 	m.Replace(remoteNode0, remote)
 
 	need := needList(m, protocol.LocalNodeID)
@@ -715,22 +717,209 @@ func TestLocalVersion(t *testing.T) {
 		protocol.FileInfo{Name: "e", Version: 1000},
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local1)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local1, 0)
 	c0 := m.LocalVersion(protocol.LocalNodeID)
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local2)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local2, 0)
 	c1 := m.LocalVersion(protocol.LocalNodeID)
 	if !(c1 > c0) {
 		t.Fatal("Local version number should have incremented")
 	}
 
-	m.ReplaceWithDelete(protocol.LocalNodeID, local2)
+	m.ReplaceWithDelete(protocol.LocalNodeID, local2, 0)
 	c2 := m.LocalVersion(protocol.LocalNodeID)
 	if c2 != c1 {
 		t.Fatal("Local version number should be unchanged")
 	}
 }
 
+func TestGlobalVectors(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+
+	local, remote := remoteNode1.Short(), remoteNode0.Short()
+	vec := func(ids ...uint64) protocol.Vector {
+		var v protocol.Vector
+		for _, id := range ids {
+			v = v.Update(id)
+		}
+		return v
+	}
+
+	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
+		// Dominated by the remote version, despite the higher lamport version
+		protocol.FileInfo{Name: "a", Version: 1000, Vector: vec(local)},
+		// Concurrent with the remote version, which has the higher lamport version
+		protocol.FileInfo{Name: "b", Version: 1000, Vector: vec(local)},
+		// Last changed before version vectors
+		protocol.FileInfo{Name: "c", Version: 1000},
+		// Same as the remote version
+		protocol.FileInfo{Name: "d", Version: 1000, Vector: vec(remote)},
+	}, local)
+	m.Replace(remoteNode0, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 999, Vector: vec(local, remote)},
+		protocol.FileInfo{Name: "b", Version: 1001, Vector: vec(remote)},
+		protocol.FileInfo{Name: "c", Version: 999, Vector: vec(remote)},
+		protocol.FileInfo{Name: "d", Version: 1000, Vector: vec(remote)},
+	})
+
+	expectedNeed := fileList{
+		protocol.FileInfo{Name: "a", Version: 999, Vector: vec(local, remote)},
+		protocol.FileInfo{Name: "b", Version: 1001, Vector: vec(remote)},
+	}
+
+	n := fileList(needList(m, protocol.LocalNodeID))
+	sort.Sort(n)
+	if fmt.Sprint(n) != fmt.Sprint(expectedNeed) {
+		t.Errorf("Need incorrect;\n A: %v !=\n E: %v", n, expectedNeed)
+	}
+
+	if g := m.GetGlobal("c"); g.Version != 1000 || !g.Vector.IsEmpty() {
+		t.Errorf("Incorrect global version of c: %v", g)
+	}
+	if av := m.Availability("d"); len(av) != 2 {
+		t.Errorf("Incorrect availability of d: %v", av)
+	}
+}
+
+func TestLocallyChanged(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+
+	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1000},
+	}, 0)
+	if !m.LocallyChanged("a") {
+		t.Error("New local file should be changed")
+	}
+	if m.LocallyChanged("b") {
+		t.Error("Unknown file should not be changed")
+	}
+
+	m.Replace(remoteNode0, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1000},
+	})
+	if m.LocallyChanged("a") {
+		t.Error("File seen by remote should not be changed")
+	}
+
+	m.Replace(remoteNode0, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1001},
+	})
+	if m.LocallyChanged("a") {
+		t.Error("File changed by remote only should not be changed")
+	}
+
+	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1002},
+	}, 0)
+	if !m.LocallyChanged("a") {
+		t.Error("File updated locally should be changed")
+	}
+}
+
+func TestLocallyChangedMigration(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := files.NewSet("test", db)
+	m.ReplaceWithDelete(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1000},
+	}, 0)
+
+	// Loading the set again must not forget that the file is changed
+	m = files.NewSet("test", db)
+	if !m.LocallyChanged("a") {
+		t.Error("Changed file should still be changed")
+	}
+
+	// A database that predates synced versions has all files in sync. Drop
+	// the marker that says synced versions are tracked to simulate one.
+	marker := make([]byte, 1+64)
+	marker[0] = 2 // keyTypeSynced
+	copy(marker[1:], "test")
+	db.Delete(marker, nil)
+
+	m = files.NewSet("test", db)
+	if m.LocallyChanged("a") {
+		t.Error("File should be in sync after migration")
+	}
+}
+
+type blockLocation struct {
+	repo, name string
+	offset     int64
+}
+
+func findBlock(f *files.BlockFinder, hash []byte) []blockLocation {
+	var locs []blockLocation
+	f.Iterate(hash, func(repo, name string, offset int64) bool {
+		locs = append(locs, blockLocation{repo, name, offset})
+		return false
+	})
+	return locs
+}
+
+func TestBlockFinder(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s0 := files.NewSet("test0", db)
+	s1 := files.NewSet("test1", db)
+	f := files.NewBlockFinder(db)
+
+	blocks := genBlocks(3)
+	s0.Update(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1000, Blocks: blocks},
+	})
+	s1.Update(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "b", Version: 1000, Blocks: blocks[2:]},
+	})
+	// Remote files are not local copies
+	s1.Update(remoteNode0, []protocol.FileInfo{
+		protocol.FileInfo{Name: "c", Version: 1000, Blocks: blocks},
+	})
+
+	expected := []blockLocation{{"test0", "a", int64(blocks[0].Size + blocks[1].Size)}, {"test1", "b", 0}}
+	if locs := findBlock(f, blocks[2].Hash); !reflect.DeepEqual(locs, expected) {
+		t.Errorf("Incorrect locations %v != %v", locs, expected)
+	}
+
+	// Changed blocks replace the old ones
+	s0.Update(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "a", Version: 1001, Blocks: blocks[:2]},
+	})
+	expected = []blockLocation{{"test1", "b", 0}}
+	if locs := findBlock(f, blocks[2].Hash); !reflect.DeepEqual(locs, expected) {
+		t.Errorf("Incorrect locations %v != %v", locs, expected)
+	}
+
+	// Deleted files have no blocks
+	s1.Update(protocol.LocalNodeID, []protocol.FileInfo{
+		protocol.FileInfo{Name: "b", Version: 1001, Flags: protocol.FlagDeleted},
+	})
+	if locs := findBlock(f, blocks[2].Hash); len(locs) != 0 {
+		t.Errorf("Unexpected locations %v", locs)
+	}
+
+	files.DropRepo(db, "test0")
+	if locs := findBlock(f, blocks[0].Hash); len(locs) != 0 {
+		t.Errorf("Unexpected locations %v after dropping repo", locs)
+	}
+}
+
 func TestListDropRepo(t *testing.T) {
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -782,6 +971,47 @@ func TestListDropRepo(t *testing.T) {
 	}
 }
 
+func TestIndexID(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := files.NewSet("test", db)
+	id := s.IndexID(protocol.LocalNodeID)
+	if id == 0 {
+		t.Fatal("No local index ID")
+	}
+	if other := files.NewSet("other", db).IndexID(protocol.LocalNodeID); other == id {
+		t.Error("Same index ID for different repos")
+	}
+	if rid := s.IndexID(remoteNode0); rid != 0 {
+		t.Errorf("Unexpected index ID %x for unknown node", rid)
+	}
+	s.SetIndexID(remoteNode0, 42)
+
+	// The IDs persist in the database
+
+	s = files.NewSet("test", db)
+	if lid := s.IndexID(protocol.LocalNodeID); lid != id {
+		t.Errorf("Local index ID changed from %x to %x", id, lid)
+	}
+	if rid := s.IndexID(remoteNode0); rid != 42 {
+		t.Errorf("Incorrect index ID %x != 42", rid)
+	}
+
+	// A dropped repo starts over with a new local index ID
+
+	files.DropRepo(db, "test")
+	s = files.NewSet("test", db)
+	if lid := s.IndexID(protocol.LocalNodeID); lid == id || lid == 0 {
+		t.Errorf("Incorrect local index ID %x after dropping the repo", lid)
+	}
+	if rid := s.IndexID(remoteNode0); rid != 0 {
+		t.Errorf("Index ID %x survived dropping the repo", rid)
+	}
+}
+
 func TestGlobalNeedWithInvalid(t *testing.T) {
 	db, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -840,7 +1070,7 @@ func TestLongPath(t *testing.T) {
 		protocol.FileInfo{Name: string(name), Version: 1000},
 	}
 
-	s.ReplaceWithDelete(protocol.LocalNodeID, local)
+	s.ReplaceWithDelete(protocol.LocalNodeID, local, 0)
 
 	gf := globalList(s)
 	if l := len(gf); l != 1 {
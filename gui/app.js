@@ -780,11 +780,16 @@ syncthing.controller('SyncthingCtrl', function ($scope, $http, $translate, $loca
 
         $('#editRepo').modal('hide');
         repoCfg = $scope.currentRepo;
+        // Keep per node settings, such as read only, for nodes that stay
+        var oldNodes = {};
+        (repoCfg.Nodes || []).forEach(function (n) {
+            oldNodes[n.NodeID] = n;
+        });
         repoCfg.Nodes = [];
         repoCfg.selectedNodes[$scope.myID] = true;
         for (var nodeID in repoCfg.selectedNodes) {
             if (repoCfg.selectedNodes[nodeID] === true) {
-                repoCfg.Nodes.push({NodeID: nodeID});
+                repoCfg.Nodes.push(oldNodes[nodeID] || {NodeID: nodeID});
             }
         }
         delete repoCfg.selectedNodes;
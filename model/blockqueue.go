@@ -18,6 +18,7 @@ type bqBlock struct {
 	copy  []protocol.BlockInfo // copy these blocks from the old version of the file
 	first bool
 	last  bool
+	tried []protocol.NodeID // nodes that failed to serve the block before
 }
 
 type blockQueue struct {
@@ -63,6 +64,11 @@ func (q *blockQueue) put(a bqAdd) {
 	}
 }
 
+// unget puts the block back at the head of the queue.
+func (q *blockQueue) unget(b bqBlock) {
+	q.queued = append([]bqBlock{b}, q.queued...)
+}
+
 func (q *blockQueue) get() (bqBlock, bool) {
 	if len(q.queued) == 0 {
 		return bqBlock{}, false
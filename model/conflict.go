@@ -0,0 +1,91 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+const conflictTimeFormat = "20060102-150405"
+
+var conflictPattern = regexp.MustCompile(`^(.+)\.sync-conflict-(\d{8}-\d{6})-([A-Z2-7]{7})$`)
+
+// conflictName returns the name under which to keep our copy of a file that
+// was changed both here and on another node.
+func conflictName(name string, t time.Time, node protocol.NodeID) string {
+	return fmt.Sprintf("%s.sync-conflict-%s-%s", name, t.Format(conflictTimeFormat), node.String()[:7])
+}
+
+// Conflict describes a conflict copy of a file.
+type Conflict struct {
+	Name     string    // name of the conflict copy
+	Original string    // name of the file it is a copy of
+	Time     time.Time // when the conflict was detected
+	Node     string    // short ID of the node whose changes are in the copy
+}
+
+// parseConflictName returns the conflict described by the file name, if it
+// is the name of a conflict copy.
+func parseConflictName(name string) (Conflict, bool) {
+	m := conflictPattern.FindStringSubmatch(name)
+	if m == nil {
+		return Conflict{}, false
+	}
+	t, err := time.ParseInLocation(conflictTimeFormat, m[2], time.Local)
+	if err != nil {
+		return Conflict{}, false
+	}
+	return Conflict{
+		Name:     name,
+		Original: m[1],
+		Time:     t,
+		Node:     m[3],
+	}, true
+}
+
+type conflictList []Conflict
+
+func (l conflictList) Len() int           { return len(l) }
+func (l conflictList) Less(a, b int) bool { return l[a].Name < l[b].Name }
+func (l conflictList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
+// Conflicts returns the conflict copies present in the repository, made
+// here or on other nodes.
+func (m *Model) Conflicts(repo string) []Conflict {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var conflicts conflictList
+	rf.WithHaveTruncated(protocol.LocalNodeID, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfoTruncated)
+		if f.IsDeleted() || f.IsInvalid() {
+			return true
+		}
+		if c, ok := parseConflictName(f.Name); ok {
+			conflicts = append(conflicts, c)
+		}
+		return true
+	})
+	sort.Sort(conflicts)
+	return conflicts
+}
+
+// locallyChanged returns true if our copy of the file contains changes that
+// no other node has seen yet.
+func (m *Model) locallyChanged(repo, name string) bool {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	return ok && rf.LocallyChanged(name)
+}
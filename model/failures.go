@@ -0,0 +1,140 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// A file that failed to sync is retried after retryMinDelay, and after twice
+// as long for each further failure of the same version, up to retryMaxDelay.
+const (
+	retryMinDelay = 1 * time.Minute
+	retryMaxDelay = 1 * time.Hour
+)
+
+// A FailedItem is a file that could not be synced, with the error from the
+// last attempt.
+type FailedItem struct {
+	Name     string
+	Error    string
+	Attempts int       // failed attempts at the current version
+	Retry    time.Time // when the file will be tried again
+	version  uint64
+}
+
+type failedItemList []FailedItem
+
+func (l failedItemList) Len() int {
+	return len(l)
+}
+
+func (l failedItemList) Less(a, b int) bool {
+	return l[a].Name < l[b].Name
+}
+
+func (l failedItemList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+// failureTracker keeps track of the files the pullers failed to sync, so
+// that they can be retried with backoff instead of stopping the repository.
+type failureTracker struct {
+	repos   map[string]map[string]*FailedItem // repo -> name -> item
+	checked map[string]time.Time              // repo -> time of the last call to due
+	mut     sync.Mutex
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{
+		repos:   make(map[string]map[string]*FailedItem),
+		checked: make(map[string]time.Time),
+	}
+}
+
+// failed records that syncing the file failed with the given error and
+// returns the updated item.
+func (t *failureTracker) failed(repo string, f protocol.FileInfo, err error, now time.Time) FailedItem {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	items, ok := t.repos[repo]
+	if !ok {
+		items = make(map[string]*FailedItem)
+		t.repos[repo] = items
+	}
+	item, ok := items[f.Name]
+	if !ok || item.version != f.Version {
+		item = &FailedItem{Name: f.Name, version: f.Version}
+		items[f.Name] = item
+	}
+
+	item.Error = err.Error()
+	item.Attempts++
+	delay := retryMinDelay
+	for i := 1; i < item.Attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	item.Retry = now.Add(delay)
+	return *item
+}
+
+// succeeded forgets any failure of the file.
+func (t *failureTracker) succeeded(repo, name string) {
+	t.mut.Lock()
+	delete(t.repos[repo], name)
+	t.mut.Unlock()
+}
+
+// retry returns true if the given version of the file may be tried now,
+// i.e. it has not failed or it is time to retry it.
+func (t *failureTracker) retry(repo, name string, version uint64, now time.Time) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	item, ok := t.repos[repo][name]
+	return !ok || item.version != version || !now.Before(item.Retry)
+}
+
+// due returns true if any failed file in the repository has become due for
+// a retry since the last call.
+func (t *failureTracker) due(repo string, now time.Time) bool {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	last := t.checked[repo]
+	t.checked[repo] = now
+	for _, item := range t.repos[repo] {
+		if item.Retry.After(last) && !item.Retry.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// items returns the failed files in the repository, sorted by name.
+func (t *failureTracker) items(repo string) []FailedItem {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	items := make(failedItemList, 0, len(t.repos[repo]))
+	for _, item := range t.repos[repo] {
+		items = append(items, *item)
+	}
+	sort.Sort(items)
+	return items
+}
+
+// FailedItems returns the files in the repository that could not be synced.
+func (m *Model) FailedItems(repo string) []FailedItem {
+	return m.failures.items(repo)
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// How many files Request keeps open for reading at most.
+const fdCacheSize = 64
+
+// An fdCache keeps the most recently read files open, so that requests for
+// consecutive blocks of a file don't each open and close it. Each file is
+// opened for a given version of it; asking for another version reopens it.
+type fdCache struct {
+	size  int
+	files map[string]*list.Element // path -> element in lru
+	lru   *list.List               // of *cachedFd, most recently used first
+	mut   sync.Mutex
+}
+
+type cachedFd struct {
+	path    string
+	version uint64
+	fd      *os.File
+	refs    int  // reads in progress
+	dropped bool // no longer in the cache; close when refs reaches zero
+}
+
+func newFdCache(size int) *fdCache {
+	return &fdCache{
+		size:  size,
+		files: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// get returns the open file for the given version of the path. The returned
+// function must be called when done reading from it.
+func (c *fdCache) get(path string, version uint64) (*os.File, func(), error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if e, ok := c.files[path]; ok {
+		cf := e.Value.(*cachedFd)
+		if cf.version == version {
+			c.lru.MoveToFront(e)
+			cf.refs++
+			return cf.fd, c.releaser(cf), nil
+		}
+		c.dropLocked(e)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cf := &cachedFd{
+		path:    path,
+		version: version,
+		fd:      fd,
+		refs:    1,
+	}
+	c.files[path] = c.lru.PushFront(cf)
+	for c.lru.Len() > c.size {
+		c.dropLocked(c.lru.Back())
+	}
+	return fd, c.releaser(cf), nil
+}
+
+func (c *fdCache) releaser(cf *cachedFd) func() {
+	return func() {
+		c.mut.Lock()
+		cf.refs--
+		if cf.dropped && cf.refs == 0 {
+			cf.fd.Close()
+		}
+		c.mut.Unlock()
+	}
+}
+
+// forget closes the file if it is open, as it has been changed, replaced or
+// removed.
+func (c *fdCache) forget(path string) {
+	c.mut.Lock()
+	if e, ok := c.files[path]; ok {
+		c.dropLocked(e)
+	}
+	c.mut.Unlock()
+}
+
+func (c *fdCache) dropLocked(e *list.Element) {
+	cf := e.Value.(*cachedFd)
+	c.lru.Remove(e)
+	delete(c.files, cf.path)
+	cf.dropped = true
+	if cf.refs == 0 {
+		cf.fd.Close()
+	}
+}
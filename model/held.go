@@ -0,0 +1,91 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A HeldFile is a changed file that the scanner did not announce, as it is
+// still being written to.
+type HeldFile struct {
+	Name       string
+	Modified   time.Time
+	InProgress bool // matches the in progress patterns of the repository
+}
+
+type heldFileList []HeldFile
+
+func (l heldFileList) Len() int {
+	return len(l)
+}
+
+func (l heldFileList) Less(a, b int) bool {
+	return l[a].Name < l[b].Name
+}
+
+func (l heldFileList) Swap(a, b int) {
+	l[a], l[b] = l[b], l[a]
+}
+
+// heldTracker keeps track of the files held back by the last scan of each
+// part of the repositories.
+type heldTracker struct {
+	repos map[string]map[string]HeldFile // repo -> name -> file
+	mut   sync.Mutex
+}
+
+func newHeldTracker() *heldTracker {
+	return &heldTracker{
+		repos: make(map[string]map[string]HeldFile),
+	}
+}
+
+// clear forgets the held files in the subtree, before it is scanned again.
+func (t *heldTracker) clear(repo, sub string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	for name := range t.repos[repo] {
+		if sub == "" || name == sub || strings.HasPrefix(name, sub+string(os.PathSeparator)) {
+			delete(t.repos[repo], name)
+		}
+	}
+}
+
+func (t *heldTracker) held(repo string, f HeldFile) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	files, ok := t.repos[repo]
+	if !ok {
+		files = make(map[string]HeldFile)
+		t.repos[repo] = files
+	}
+	files[f.Name] = f
+}
+
+// files returns the held files in the repository, sorted by name.
+func (t *heldTracker) files(repo string) []HeldFile {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	files := make(heldFileList, 0, len(t.repos[repo]))
+	for _, f := range t.repos[repo] {
+		files = append(files, f)
+	}
+	sort.Sort(files)
+	return files
+}
+
+// HeldFiles returns the changed files in the repository that have not been
+// announced to other nodes, as they are still being written to.
+func (m *Model) HeldFiles(repo string) []HeldFile {
+	return m.held.files(repo)
+}
@@ -5,6 +5,7 @@
 package model
 
 import (
+	"bytes"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -35,6 +36,8 @@ const (
 	RepoScanning
 	RepoSyncing
 	RepoCleaning
+	RepoOutOfSpace
+	RepoPaused
 )
 
 func (s repoState) String() string {
@@ -47,6 +50,10 @@ func (s repoState) String() string {
 		return "cleaning"
 	case RepoSyncing:
 		return "syncing"
+	case RepoOutOfSpace:
+		return "outofspace"
+	case RepoPaused:
+		return "paused"
 	default:
 		return "unknown"
 	}
@@ -64,6 +71,8 @@ type Model struct {
 	indexDir string
 	cfg      *config.Configuration
 	db       *leveldb.DB
+	myID     protocol.NodeID
+	shortID  uint64
 
 	nodeName      string
 	clientName    string
@@ -75,34 +84,52 @@ type Model struct {
 	nodeRepos    map[protocol.NodeID][]string                       // nodeID -> repos
 	nodeStatRefs map[protocol.NodeID]*stats.NodeStatisticsReference // nodeID -> statsRef
 	repoIgnores  map[string]ignore.Patterns                         // repo -> list of ignore patterns
+	repoScans    map[string]*sync.Mutex                             // repo -> held while the repo is being scanned
 	rmut         sync.RWMutex                                       // protects the above
 
-	repoState        map[string]repoState // repo -> state
-	repoStateChanged map[string]time.Time // repo -> time when state changed
+	repoState        map[string]repoState     // repo -> state
+	repoStateChanged map[string]time.Time     // repo -> time when state changed
+	repoPaused       map[string]bool          // repo -> paused by the user
+	repoResumeState  map[string]repoState     // repo -> state to return to when resumed
+	nodePaused       map[protocol.NodeID]bool // nodeID -> paused by the user
 	smut             sync.RWMutex
 
-	protoConn map[protocol.NodeID]protocol.Connection
-	rawConn   map[protocol.NodeID]io.Closer
-	nodeVer   map[protocol.NodeID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	protoConn     map[protocol.NodeID]protocol.Connection
+	rawConn       map[protocol.NodeID]io.Closer
+	nodeVer       map[protocol.NodeID]string
+	nodeCC        map[protocol.NodeID]protocol.ClusterConfigMessage   // cluster config received from each connected node
+	trafficSaved  map[protocol.NodeID]protocol.Traffic                // connection traffic already added to the node statistics
+	nodeDownloads map[protocol.NodeID]map[string]map[string]*download // nodeID -> repo -> name -> files the node is downloading
+	pmut          sync.RWMutex                                        // protects the above
+
+	downloads *downloadTracker   // files we are downloading
+	failures  *failureTracker    // files we failed to sync
+	fds       *fdCache           // files open for serving requests
+	rates     *throughputTracker // how fast blocks arrive from each node
+	held      *heldTracker       // changed files not yet announced
+	finder    *files.BlockFinder // blocks in local files
 
 	addedRepo bool
 	started   bool
 }
 
+// Errors returned by Request. They are shared with the protocol package so
+// that they are passed on to the requesting node.
 var (
-	ErrNoSuchFile = errors.New("no such file")
-	ErrInvalid    = errors.New("file is invalid")
+	ErrNoSuchFile = protocol.ErrNoSuchFile
+	ErrInvalid    = protocol.ErrInvalid
 )
 
 // NewModel creates and starts a new model. The model starts in read-only mode,
 // where it sends index information to connected peers and responds to requests
 // for file data without altering the local repository in any way.
-func NewModel(indexDir string, cfg *config.Configuration, nodeName, clientName, clientVersion string, db *leveldb.DB) *Model {
+func NewModel(indexDir string, cfg *config.Configuration, myID protocol.NodeID, nodeName, clientName, clientVersion string, db *leveldb.DB) *Model {
 	m := &Model{
 		indexDir:         indexDir,
 		cfg:              cfg,
 		db:               db,
+		myID:             myID,
+		shortID:          myID.Short(),
 		nodeName:         nodeName,
 		clientName:       clientName,
 		clientVersion:    clientVersion,
@@ -112,15 +139,29 @@ func NewModel(indexDir string, cfg *config.Configuration, nodeName, clientName,
 		nodeRepos:        make(map[protocol.NodeID][]string),
 		nodeStatRefs:     make(map[protocol.NodeID]*stats.NodeStatisticsReference),
 		repoIgnores:      make(map[string]ignore.Patterns),
+		repoScans:        make(map[string]*sync.Mutex),
 		repoState:        make(map[string]repoState),
 		repoStateChanged: make(map[string]time.Time),
+		repoPaused:       make(map[string]bool),
+		repoResumeState:  make(map[string]repoState),
+		nodePaused:       make(map[protocol.NodeID]bool),
 		protoConn:        make(map[protocol.NodeID]protocol.Connection),
 		rawConn:          make(map[protocol.NodeID]io.Closer),
 		nodeVer:          make(map[protocol.NodeID]string),
+		nodeCC:           make(map[protocol.NodeID]protocol.ClusterConfigMessage),
+		trafficSaved:     make(map[protocol.NodeID]protocol.Traffic),
+		nodeDownloads:    make(map[protocol.NodeID]map[string]map[string]*download),
+		downloads:        newDownloadTracker(),
+		failures:         newFailureTracker(),
+		fds:              newFdCache(fdCacheSize),
+		rates:            newThroughputTracker(),
+		held:             newHeldTracker(),
+		finder:           files.NewBlockFinder(db),
 	}
 
 	for _, node := range cfg.Nodes {
 		m.nodeStatRefs[node.NodeID] = stats.NewNodeStatisticsReference(db, node.NodeID)
+		m.nodePaused[node.NodeID] = node.Paused
 	}
 
 	var timeout = 20 * 60 // seconds
@@ -133,6 +174,8 @@ func NewModel(indexDir string, cfg *config.Configuration, nodeName, clientName,
 	deadlockDetect(&m.rmut, time.Duration(timeout)*time.Second)
 	deadlockDetect(&m.smut, time.Duration(timeout)*time.Second)
 	deadlockDetect(&m.pmut, time.Duration(timeout)*time.Second)
+	go m.saveConnStatsLoop()
+	go m.sendDownloadProgressLoop()
 	return m
 }
 
@@ -194,12 +237,62 @@ func (m *Model) ConnectionStats() map[string]ConnectionInfo {
 			At:            time.Now(),
 			InBytesTotal:  in,
 			OutBytesTotal: out,
+			Traffic:       protocol.TotalTraffic(),
 		},
 	}
 
 	return res
 }
 
+// How often the traffic counters and link quality of open connections are
+// saved to the node statistics.
+const connStatsSaveInterval = 5 * time.Minute
+
+func (m *Model) saveConnStatsLoop() {
+	for _ = range time.Tick(connStatsSaveInterval) {
+		m.pmut.Lock()
+		for node := range m.protoConn {
+			m.saveConnStats(node)
+		}
+		m.pmut.Unlock()
+	}
+}
+
+// saveConnStats adds the traffic seen on the connection to the node since
+// the last call to the node statistics, and stores the current link
+// quality. Must be called with pmut held.
+func (m *Model) saveConnStats(node protocol.NodeID) {
+	conn, ok := m.protoConn[node]
+	if !ok {
+		return
+	}
+	m.rmut.RLock()
+	statRef, ok := m.nodeStatRefs[node]
+	m.rmut.RUnlock()
+	if !ok {
+		return
+	}
+
+	stats := conn.Statistics()
+	statRef.AddTraffic(stats.Traffic.Sub(m.trafficSaved[node]))
+	m.trafficSaved[node] = stats.Traffic
+	if stats.LinkQuality != (protocol.LinkQuality{}) {
+		statRef.SetLinkQuality(stats.LinkQuality)
+	}
+}
+
+// nodeLatency returns the current estimate of the time it takes to get a
+// block from the node, or zero if unknown.
+func (m *Model) nodeLatency(node protocol.NodeID) time.Duration {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[node]
+	m.pmut.RUnlock()
+	if !ok {
+		return 0
+	}
+	return conn.Statistics().Latency()
+}
+
 // Returns statistics about each node
 func (m *Model) NodeStatistics() map[string]stats.NodeStatistics {
 	var res = make(map[string]stats.NodeStatistics)
@@ -359,6 +452,13 @@ func (m *Model) Index(nodeID protocol.NodeID, repo string, fs []protocol.FileInf
 		return
 	}
 
+	if m.nodeReadOnly(repo, nodeID) {
+		if debug {
+			l.Debugf(logPrefix, "IDX(in): %s %q: ignored, node is read only", nodeID, repo)
+		}
+		return
+	}
+
 	m.rmut.RLock()
 	files, ok := m.repoFiles[repo]
 	ignores, _ := m.repoIgnores[repo]
@@ -380,6 +480,17 @@ func (m *Model) Index(nodeID protocol.NodeID, repo string, fs []protocol.FileInf
 
 	files.Replace(nodeID, fs)
 
+	// The files now come from the index the node announced in its cluster
+	// config. Without one, the ID stays as it was; at worst that makes the
+	// node send its full index again on the next connection.
+	m.pmut.RLock()
+	cc, ok := m.nodeCC[nodeID]
+	m.pmut.RUnlock()
+	if ok {
+		own, _ := indexIDs(cc, repo)
+		files.SetIndexID(nodeID, own)
+	}
+
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
 		"node":    nodeID.String(),
 		"repo":    repo,
@@ -400,6 +511,13 @@ func (m *Model) IndexUpdate(nodeID protocol.NodeID, repo string, fs []protocol.F
 		return
 	}
 
+	if m.nodeReadOnly(repo, nodeID) {
+		if debug {
+			l.Debugf(logPrefix, "IDXUP(in): %s / %q: ignored, node is read only", nodeID, repo)
+		}
+		return
+	}
+
 	m.rmut.RLock()
 	files, ok := m.repoFiles[repo]
 	ignores, _ := m.repoIgnores[repo]
@@ -440,6 +558,19 @@ func (m *Model) repoSharedWith(repo string, nodeID protocol.NodeID) bool {
 	return false
 }
 
+// nodeReadOnly returns true if the node may not change the repository, i.e.
+// if its index is to be ignored.
+func (m *Model) nodeReadOnly(repo string, nodeID protocol.NodeID) bool {
+	m.rmut.RLock()
+	defer m.rmut.RUnlock()
+	for _, node := range m.repoCfgs[repo].Nodes {
+		if node.NodeID == nodeID {
+			return node.ReadOnly
+		}
+	}
+	return false
+}
+
 func (m *Model) ClusterConfig(nodeID protocol.NodeID, config protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
 	if config.ClientName == "syncthing" {
@@ -447,6 +578,18 @@ func (m *Model) ClusterConfig(nodeID protocol.NodeID, config protocol.ClusterCon
 	} else {
 		m.nodeVer[nodeID] = config.ClientName + " " + config.ClientVersion
 	}
+	m.nodeCC[nodeID] = config
+	for _, repo := range config.Repositories {
+		if sharedReadOnly(config, repo.ID, m.myID) {
+			l.Infof(logPrefix, "Node %s shares repository %q read only with us; our changes will not be sent to it", nodeID, repo.ID)
+		}
+	}
+	if conn, ok := m.protoConn[nodeID]; ok {
+		// We have already sent our cluster config, so this is the last
+		// piece of information needed to start the index exchange. If the
+		// connection hasn't been added yet, AddConnection will do it.
+		m.startIndexSenders(conn, config)
+	}
 	m.pmut.Unlock()
 
 	l.Infof(logPrefix, "Node %s client is \"%s %s\"", nodeID, config.ClientName, config.ClientVersion)
@@ -471,12 +614,6 @@ func (m *Model) Close(node protocol.NodeID, err error) {
 	})
 
 	m.pmut.Lock()
-	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[node] {
-		m.repoFiles[repo].Replace(node, nil)
-	}
-	m.rmut.RUnlock()
-
 	conn, ok := m.rawConn[node]
 	if ok {
 		if conn, ok := conn.(*tls.Conn); ok {
@@ -488,15 +625,26 @@ func (m *Model) Close(node protocol.NodeID, err error) {
 		}
 		conn.Close()
 	}
+	m.saveConnStats(node)
+	delete(m.trafficSaved, node)
 	delete(m.protoConn, node)
 	delete(m.rawConn, node)
 	delete(m.nodeVer, node)
+	delete(m.nodeCC, node)
+	delete(m.nodeDownloads, node)
 	m.pmut.Unlock()
+	m.rates.forget(node)
 }
 
 // Request returns the specified data segment by reading it from local disk.
-// Implements the protocol.Model interface.
-func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64, size int) ([]byte, error) {
+// With the protocol.FlagRequestTemporary flag the data is read from the
+// temporary file of a download in progress instead. Implements the
+// protocol.Model interface.
+func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64, size int, flags uint32) ([]byte, error) {
+	if flags&protocol.FlagRequestTemporary != 0 {
+		return m.requestTemporary(nodeID, repo, name, offset, size)
+	}
+
 	// Verify that the requested file exists in the local model.
 	m.rmut.RLock()
 	r, ok := m.repoFiles[repo]
@@ -528,10 +676,41 @@ func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64,
 	m.rmut.RLock()
 	fn := filepath.Join(m.repoCfgs[repo].Directory, name)
 	m.rmut.RUnlock()
-	fd, err := os.Open(fn) // XXX: Inefficient, should cache fd?
+	fd, done, err := m.fds.get(fn, lf.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	buf := make([]byte, size)
+	_, err = fd.ReadAt(buf, offset)
 	if err != nil {
 		return nil, err
 	}
+
+	return buf, nil
+}
+
+// requestTemporary returns the specified data segment from the temporary
+// file of a download in progress, as advertised to the node by
+// sendDownloadProgressLoop.
+func (m *Model) requestTemporary(nodeID protocol.NodeID, repo, name string, offset int64, size int) ([]byte, error) {
+	temp, ok := m.downloads.temporary(repo, name, uint32(offset/protocol.BlockSize))
+	if !ok {
+		if debug {
+			l.Debugf(logPrefix, "REQ(in; temp; nonexistent): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
+		}
+		return nil, ErrNoSuchFile
+	}
+
+	if debug {
+		l.Debugf(logPrefix, "REQ(in; temp): %s: %q / %q o=%d s=%d", nodeID, repo, name, offset, size)
+	}
+	fd, err := os.Open(temp)
+	if err != nil {
+		// The download finished or failed since we checked
+		return nil, ErrNoSuchFile
+	}
 	defer fd.Close()
 
 	buf := make([]byte, size)
@@ -543,11 +722,91 @@ func (m *Model) Request(nodeID protocol.NodeID, repo, name string, offset int64,
 	return buf, nil
 }
 
+// DownloadProgress is called when a node tells us which files it is
+// downloading and which blocks of them it has. Implements the protocol.Model
+// interface.
+func (m *Model) DownloadProgress(nodeID protocol.NodeID, repo string, fs []protocol.FileDownloadProgress) {
+	if debug {
+		l.Debugf(logPrefix, "PROGRESS(in): %s / %q: %d files", nodeID, repo, len(fs))
+	}
+
+	if !m.repoSharedWith(repo, nodeID) || m.nodeReadOnly(repo, nodeID) {
+		return
+	}
+
+	downloads := make(map[string]*download, len(fs))
+	for _, f := range fs {
+		downloads[f.Name] = newDownload(f.Version, "", f.Blocks)
+	}
+
+	m.pmut.Lock()
+	repos, ok := m.nodeDownloads[nodeID]
+	if !ok {
+		repos = make(map[string]map[string]*download)
+		m.nodeDownloads[nodeID] = repos
+	}
+	repos[repo] = downloads
+	m.pmut.Unlock()
+}
+
+// downloadSources returns the nodes that are downloading the same version of
+// the file as we are and already have the block with the given index.
+func (m *Model) downloadSources(repo string, f protocol.FileInfo, index uint32) []protocol.NodeID {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+
+	var nodes []protocol.NodeID
+	for node, repos := range m.nodeDownloads {
+		if d, ok := repos[repo][f.Name]; ok && d.version == f.Version && d.hasBlock(index) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func (m *Model) sendDownloadProgressLoop() {
+	for _ = range time.Tick(downloadProgressInterval) {
+		for repo, fs := range m.downloads.changes() {
+			m.rmut.RLock()
+			nodes := m.repoNodes[repo]
+			m.rmut.RUnlock()
+
+			m.pmut.RLock()
+			var conns []protocol.Connection
+			for _, node := range nodes {
+				if _, ok := m.nodeCC[node]; !ok {
+					// We don't know yet whether the node can take it
+					continue
+				}
+				if conn, ok := m.protoConn[node]; ok {
+					conns = append(conns, conn)
+				}
+			}
+			m.pmut.RUnlock()
+
+			for _, conn := range conns {
+				if debug {
+					l.Debugf(logPrefix, "PROGRESS(out): %s / %q: %d files", conn.ID(), repo, len(fs))
+				}
+				conn.DownloadProgress(repo, fs)
+			}
+		}
+	}
+}
+
 // ReplaceLocal replaces the local repository index with the given list of files.
 func (m *Model) ReplaceLocal(repo string, fs []protocol.FileInfo) {
 	m.rmut.RLock()
-	m.repoFiles[repo].ReplaceWithDelete(protocol.LocalNodeID, fs)
+	m.repoFiles[repo].ReplaceWithDelete(protocol.LocalNodeID, fs, m.shortID)
+	m.rmut.RUnlock()
+}
+
+// repoDir returns the directory of the repository, if it exists.
+func (m *Model) repoDir(repo string) (string, bool) {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
 	m.rmut.RUnlock()
+	return cfg.Directory, ok
 }
 
 func (m *Model) CurrentRepoFile(repo string, file string) protocol.FileInfo {
@@ -588,8 +847,8 @@ func (m *Model) ConnectedTo(nodeID protocol.NodeID) bool {
 }
 
 // AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// repository changes.
+// be sent to the connected peer once we have its cluster config, thereafter
+// index updates whenever the local repository changes.
 func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
 	nodeID := protoConn.ID()
 
@@ -606,11 +865,11 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	cm := m.clusterConfig(nodeID)
 	protoConn.ClusterConfig(cm)
 
-	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[nodeID] {
-		fs := m.repoFiles[repo]
-		go sendIndexes(protoConn, repo, fs, m.repoIgnores[repo])
+	if cc, ok := m.nodeCC[nodeID]; ok {
+		m.startIndexSenders(protoConn, cc)
 	}
+
+	m.rmut.RLock()
 	if statRef, ok := m.nodeStatRefs[nodeID]; ok {
 		statRef.WasSeen()
 	} else {
@@ -620,7 +879,101 @@ func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection)
 	m.pmut.Unlock()
 }
 
-func sendIndexes(conn protocol.Connection, repo string, fs *files.Set, ignores ignore.Patterns) {
+// startIndexSenders starts the index senders for all repositories shared with
+// the node on the other side of conn. The peer's cluster config tells us how
+// much of our index it already has. Must be called with pmut held.
+func (m *Model) startIndexSenders(conn protocol.Connection, cc protocol.ClusterConfigMessage) {
+	nodeID := conn.ID()
+
+	m.rmut.RLock()
+	for _, repo := range m.nodeRepos[nodeID] {
+		if sharedReadOnly(cc, repo, m.myID) {
+			// The peer ignores our index, but needs an initial one
+			// before it serves our requests.
+			go conn.Index(repo, nil)
+			continue
+		}
+		fs := m.repoFiles[repo]
+		startVer := indexStartVersion(cc, repo, m.myID, fs.IndexID(protocol.LocalNodeID), fs.LocalVersion(protocol.LocalNodeID))
+		go sendIndexes(conn, repo, fs, m.repoIgnores[repo], startVer)
+		if progress := m.downloads.progress(repo); len(progress) > 0 {
+			// Later changes are sent by sendDownloadProgressLoop
+			go conn.DownloadProgress(repo, progress)
+		}
+	}
+	m.rmut.RUnlock()
+}
+
+// sharedReadOnly returns true if the peer's cluster config marks us as read
+// only for the repository, i.e. the peer does not accept our changes.
+func sharedReadOnly(cc protocol.ClusterConfigMessage, repo string, myID protocol.NodeID) bool {
+	for _, r := range cc.Repositories {
+		if r.ID != repo {
+			continue
+		}
+		for _, n := range r.Nodes {
+			if bytes.Equal(n.ID, myID[:]) {
+				return n.Flags&protocol.FlagShareReadOnly != 0
+			}
+		}
+	}
+	return false
+}
+
+// indexStartVersion returns the local version from which the index for the
+// given repository should be sent, based on the Max Local Version the peer
+// advertises for us in its cluster config. Zero means that a full index must
+// be sent. This is the case when the peer doesn't know our index (it's a new
+// peer, an older version or its database has been reset), when what it knows
+// is from another index than our current one (our database has been reset)
+// or when it claims to know more than we have.
+func indexStartVersion(cc protocol.ClusterConfigMessage, repo string, myID protocol.NodeID, myIndexID, curVer uint64) uint64 {
+	if _, ours := indexIDs(cc, repo); ours != myIndexID {
+		return 0
+	}
+	for _, r := range cc.Repositories {
+		if r.ID != repo {
+			continue
+		}
+		for _, n := range r.Nodes {
+			if !bytes.Equal(n.ID, myID[:]) {
+				continue
+			}
+			if n.MaxLocalVersion > curVer {
+				return 0
+			}
+			return n.MaxLocalVersion
+		}
+	}
+	return 0
+}
+
+// The index IDs for the repository at position i in a cluster config are
+// carried in the option named indexIDOption(i), as two hexadecimal numbers:
+// the sender's own index ID and the index ID of the recipient's files that
+// the sender has, i.e. what the Max Local Version for the recipient refers
+// to. The options are left out for repositories beyond the first
+// maxIndexIDOptions, to stay within the limit on the number of options.
+const maxIndexIDOptions = 48
+
+func indexIDOption(i int) string {
+	return "indexID" + strconv.Itoa(i)
+}
+
+// indexIDs returns the index IDs carried in the cluster config for the
+// repository: the sender's own, and the one of ours that the sender has. A
+// zero means that the sender didn't say.
+func indexIDs(cc protocol.ClusterConfigMessage, repo string) (own, ours uint64) {
+	for i, r := range cc.Repositories {
+		if r.ID == repo {
+			fmt.Sscanf(cc.GetOption(indexIDOption(i)), "%x %x", &own, &ours)
+			break
+		}
+	}
+	return
+}
+
+func sendIndexes(conn protocol.Connection, repo string, fs *files.Set, ignores ignore.Patterns, startVer uint64) {
 	nodeID := conn.ID()
 	name := conn.Name()
 	var err error
@@ -635,7 +988,7 @@ func sendIndexes(conn protocol.Connection, repo string, fs *files.Set, ignores i
 		}
 	}()
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, repo, fs, ignores)
+	minLocalVer, err := sendIndexTo(true, startVer, conn, repo, fs, ignores)
 
 	for err == nil {
 		time.Sleep(5 * time.Second)
@@ -647,12 +1000,17 @@ func sendIndexes(conn protocol.Connection, repo string, fs *files.Set, ignores i
 	}
 }
 
+// sendIndexTo sends the files with a local version higher than minLocalVer to
+// the peer. The first message on a connection (initial) is a full Index,
+// unless the peer already has our index up to minLocalVer. In that case an
+// Index Update takes its place, and is sent even when there are no changes.
 func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, repo string, fs *files.Set, ignores ignore.Patterns) (uint64, error) {
 	nodeID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	currentBatchSize := 0
-	maxLocalVer := uint64(0)
+	maxLocalVer := minLocalVer
+	full := initial && minLocalVer == 0
 	var err error
 
 	fs.WithHave(protocol.LocalNodeID, func(fi protocol.FileIntf) bool {
@@ -670,14 +1028,14 @@ func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, rep
 		}
 
 		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
-			if initial {
+			if full {
 				if err = conn.Index(repo, batch); err != nil {
 					return false
 				}
 				if debug {
 					l.Debugf(logPrefix, "sendIndexes for %s-%s/%q: %d files (<%d bytes) (initial index)", nodeID, name, repo, len(batch), currentBatchSize)
 				}
-				initial = false
+				full = false
 			} else {
 				if err = conn.IndexUpdate(repo, batch); err != nil {
 					return false
@@ -686,6 +1044,7 @@ func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, rep
 					l.Debugf(logPrefix, "sendIndexes for %s-%s/%q: %d files (<%d bytes) (batched update)", nodeID, name, repo, len(batch), currentBatchSize)
 				}
 			}
+			initial = false
 
 			batch = make([]protocol.FileInfo, 0, indexBatchSize)
 			currentBatchSize = 0
@@ -696,12 +1055,12 @@ func sendIndexTo(initial bool, minLocalVer uint64, conn protocol.Connection, rep
 		return true
 	})
 
-	if initial && err == nil {
+	if full && err == nil {
 		err = conn.Index(repo, batch)
 		if debug && err == nil {
 			l.Debugf(logPrefix, "sendIndexes for %s-%s/%q: %d files (small initial index)", nodeID, name, repo, len(batch))
 		}
-	} else if len(batch) > 0 && err == nil {
+	} else if (len(batch) > 0 || initial) && err == nil {
 		err = conn.IndexUpdate(repo, batch)
 		if debug && err == nil {
 			l.Debugf(logPrefix, "sendIndexes for %s-%s/%q: %d files (last batch)", nodeID, name, repo, len(batch))
@@ -716,6 +1075,7 @@ func (m *Model) updateLocal(repo string, f protocol.FileInfo) {
 	m.rmut.RLock()
 	m.repoFiles[repo].Update(protocol.LocalNodeID, []protocol.FileInfo{f})
 	m.rmut.RUnlock()
+	m.failures.succeeded(repo, f.Name)
 	events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 		"repo":     repo,
 		"name":     f.Name,
@@ -725,7 +1085,9 @@ func (m *Model) updateLocal(repo string, f protocol.FileInfo) {
 	})
 }
 
-func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte) ([]byte, error) {
+// requestGlobal fetches a block from the given node, giving up with
+// protocol.ErrTimeout if there is no response within the timeout.
+func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset int64, size int, hash []byte, flags uint32, timeout time.Duration) ([]byte, error) {
 	m.pmut.RLock()
 	nc, ok := m.protoConn[nodeID]
 	m.pmut.RUnlock()
@@ -735,10 +1097,14 @@ func (m *Model) requestGlobal(nodeID protocol.NodeID, repo, name string, offset
 	}
 
 	if debug {
-		l.Debugf(logPrefix, "REQ(out): %s: %q / %q o=%d s=%d h=%x", nodeID, repo, name, offset, size, hash)
+		l.Debugf(logPrefix, "REQ(out): %s: %q / %q o=%d s=%d h=%x f=%x", nodeID, repo, name, offset, size, hash, flags)
 	}
 
-	return nc.Request(repo, name, offset, size)
+	data, err := nc.RequestDeadline(repo, name, offset, size, flags, time.Now().Add(timeout), nil)
+	if err == nil {
+		m.rates.received(nodeID, len(data), time.Now())
+	}
+	return data, err
 }
 
 func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
@@ -752,6 +1118,7 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 	m.rmut.Lock()
 	m.repoCfgs[cfg.ID] = cfg
 	m.repoFiles[cfg.ID] = files.NewSet(cfg.ID, m.db)
+	m.repoScans[cfg.ID] = new(sync.Mutex)
 
 	m.repoNodes[cfg.ID] = make([]protocol.NodeID, len(cfg.Nodes))
 	for i, node := range cfg.Nodes {
@@ -761,6 +1128,13 @@ func (m *Model) AddRepo(cfg config.RepositoryConfiguration) {
 
 	m.addedRepo = true
 	m.rmut.Unlock()
+
+	m.smut.Lock()
+	m.repoPaused[cfg.ID] = cfg.Paused
+	if cfg.Paused {
+		m.repoState[cfg.ID] = RepoPaused
+	}
+	m.smut.Unlock()
 }
 
 func (m *Model) ScanRepos() {
@@ -777,7 +1151,7 @@ func (m *Model) ScanRepos() {
 		repo := repo
 		go func() {
 			err := m.ScanRepo(repo)
-			if err != nil {
+			if err != nil && err != ErrRepoPaused {
 				invalidateRepo(m.cfg, repo, err)
 			}
 			wg.Done()
@@ -798,8 +1172,9 @@ func (m *Model) CleanRepos() {
 	wg.Add(len(dirs))
 	for _, dir := range dirs {
 		w := &scanner.Walker{
-			Dir:       dir,
-			TempNamer: defTempNamer,
+			Dir:          dir,
+			TempNamer:    defTempNamer,
+			TempLifetime: tempLifetime,
 		}
 		go func() {
 			w.CleanTempFiles()
@@ -818,12 +1193,36 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 		return errors.New("invalid subpath")
 	}
 
+	if m.RepoPaused(repo) {
+		return ErrRepoPaused
+	}
+
 	m.rmut.RLock()
 	fs, ok := m.repoFiles[repo]
-	dir := m.repoCfgs[repo].Directory
+	cfg := m.repoCfgs[repo]
+	scanning := m.repoScans[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return errors.New("no such repo")
+	}
+
+	// Concurrent scans, such as of changes seen by the watcher during a
+	// full scan, would interleave their updates to the index.
+	scanning.Lock()
+	defer scanning.Unlock()
+
+	dir := cfg.Directory
+	receiveOnly := cfg.ReceiveOnly
 
 	ignores, _ := ignore.Load(filepath.Join(dir, ".stignore"))
+	m.rmut.Lock()
 	m.repoIgnores[repo] = ignores
+	m.rmut.Unlock()
+
+	inProgress, err := ignore.Parse(strings.NewReader(strings.Join(cfg.InProgress, "\n")), "")
+	if err != nil {
+		l.Infof(logPrefix, "%q: in progress patterns: %v", repo, err)
+	}
 
 	w := &scanner.Walker{
 		Dir:          dir,
@@ -832,13 +1231,21 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 		BlockSize:    scanner.StandardBlockSize,
 		TempNamer:    defTempNamer,
 		CurrentFiler: cFiler{m, repo},
-		IgnorePerms:  m.repoCfgs[repo].IgnorePerms,
-	}
-	m.rmut.RUnlock()
-	if !ok {
-		return errors.New("no such repo")
+		IgnorePerms:  cfg.IgnorePerms,
+		ShortID:      m.shortID,
+		StableTime:   time.Duration(cfg.StableTimeS) * time.Second,
+		InProgress:   inProgress,
+		Held: func(name string, modified time.Time, inProgress bool) {
+			m.held.held(repo, HeldFile{
+				Name:       name,
+				Modified:   modified,
+				InProgress: inProgress,
+			})
+		},
 	}
 
+	m.held.clear(repo, sub)
+
 	m.setState(repo, RepoScanning)
 	fchan, err := w.Walk()
 
@@ -847,6 +1254,7 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 	}
 	batchSize := 100
 	batch := make([]protocol.FileInfo, 0, 00)
+	renamed := make(map[string]bool)
 	for f := range fchan {
 		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 			"repo":     repo,
@@ -855,10 +1263,29 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 			"flags":    fmt.Sprintf("0%o", f.Flags),
 			"size":     f.Size(),
 		})
-		if len(batch) == batchSize {
+		// A rename must be announced as the deletion and the new file in the
+		// same batch, so that other nodes can see it for what it is.
+		nf, isRename := m.renamedFrom(repo, dir, f, renamed)
+		if receiveOnly {
+			// Local changes are kept out of the global version
+			f.Flags |= protocol.FlagInvalid
+			nf.Flags |= protocol.FlagInvalid
+		}
+		if len(batch) >= batchSize-1 {
 			fs.Update(protocol.LocalNodeID, batch)
 			batch = batch[:0]
 		}
+		if isRename {
+			renamed[nf.Name] = true
+			events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
+				"repo":     repo,
+				"name":     nf.Name,
+				"modified": time.Unix(nf.Modified, 0),
+				"flags":    fmt.Sprintf("0%o", nf.Flags),
+				"size":     nf.Size(),
+			})
+			batch = append(batch, nf)
+		}
 		batch = append(batch, f)
 	}
 	if len(batch) > 0 {
@@ -895,6 +1322,7 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 					Flags:    f.Flags | protocol.FlagInvalid,
 					Modified: f.Modified,
 					Version:  f.Version, // The file is still the same, so don't bump version
+					Vector:   f.Vector,
 				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"repo":     repo,
@@ -906,11 +1334,16 @@ func (m *Model) ScanRepoSub(repo, sub string) error {
 				batch = append(batch, nf)
 			} else if _, err := os.Stat(filepath.Join(dir, f.Name)); err != nil && os.IsNotExist(err) {
 				// File has been deleted
+				m.fds.forget(filepath.Join(dir, f.Name))
 				nf := protocol.FileInfo{
 					Name:     f.Name,
 					Flags:    f.Flags | protocol.FlagDeleted,
 					Modified: f.Modified,
 					Version:  lamport.Default.Tick(f.Version),
+					Vector:   f.Vector.Update(m.shortID),
+				}
+				if receiveOnly {
+					nf.Flags |= protocol.FlagInvalid
 				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"repo":     repo,
@@ -946,15 +1379,33 @@ func (m *Model) clusterConfig(node protocol.NodeID) protocol.ClusterConfigMessag
 	}
 
 	m.rmut.RLock()
-	for _, repo := range m.nodeRepos[node] {
+	for i, repo := range m.nodeRepos[node] {
 		cr := protocol.Repository{
 			ID: repo,
 		}
-		for _, node := range m.repoNodes[repo] {
-			// TODO: Set read only bit when relevant
+		fs := m.repoFiles[repo]
+		if i < maxIndexIDOptions {
+			cm.Options = append(cm.Options, protocol.Option{
+				Key:   indexIDOption(i),
+				Value: fmt.Sprintf("%x %x", fs.IndexID(protocol.LocalNodeID), fs.IndexID(node)),
+			})
+		}
+		repoCfg := m.repoCfgs[repo]
+		for _, rn := range repoCfg.Nodes {
+			node := rn.NodeID
+			flags := protocol.FlagShareTrusted
+			if node == m.myID && repoCfg.ReadOnly || node != m.myID && rn.ReadOnly {
+				// Either we are the master for this repository, or we
+				// don't accept changes from the node.
+				flags = protocol.FlagShareReadOnly
+			}
 			cr.Nodes = append(cr.Nodes, protocol.Node{
 				ID:    node[:],
-				Flags: protocol.FlagShareTrusted,
+				Flags: flags,
+				// The highest local version we have seen from the node, so
+				// that it can skip what we already know when sending its
+				// initial index.
+				MaxLocalVersion: fs.LocalVersion(node),
 			})
 		}
 		cm.Repositories = append(cm.Repositories, cr)
@@ -966,6 +1417,14 @@ func (m *Model) clusterConfig(node protocol.NodeID) protocol.ClusterConfigMessag
 
 func (m *Model) setState(repo string, state repoState) {
 	m.smut.Lock()
+	if m.repoPaused[repo] {
+		// Files being pulled when the repository was paused are still
+		// completed, but the repository stays paused.
+		if state != RepoPaused {
+			m.repoResumeState[repo] = state
+		}
+		state = RepoPaused
+	}
 	oldState := m.repoState[repo]
 	changed, ok := m.repoStateChanged[repo]
 	if state != oldState {
@@ -1012,10 +1471,13 @@ func (m *Model) Override(repo string) {
 			need.Flags |= protocol.FlagDeleted
 			need.Blocks = nil
 		} else {
-			// We have the file, replace with our version
+			// We have the file, replace with our version. The vector must
+			// dominate the one we override.
+			have.Vector = have.Vector.Merge(need.Vector)
 			need = have
 		}
 		need.Version = lamport.Default.Tick(need.Version)
+		need.Vector = need.Vector.Update(m.shortID)
 		need.LocalVersion = 0
 		batch = append(batch, need)
 		return true
@@ -6,20 +6,26 @@ package model
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/syncthing/syncthing/config"
 	"github.com/syncthing/syncthing/protocol"
+	"github.com/syncthing/syncthing/protocol/testutil"
+	"github.com/syncthing/syncthing/scanner"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
 
-var node1, node2 protocol.NodeID
+var node0, node1, node2 protocol.NodeID
 
 func init() {
+	node0, _ = protocol.NodeIDFromString("I5EVLIP-JVEMW2C-AU4B6SJ-HZEW6LA-ZZ7MYRV-Y3HJFB7-CYCPCNT-4ZUK7A2")
 	node1, _ = protocol.NodeIDFromString("AIR6LPZ-7K4PTTV-UXQSMUU-CPQ5YWH-OEDFIIQ-JUG777G-2YQXXR5-YD6AWQR")
 	node2, _ = protocol.NodeIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
 }
@@ -57,11 +63,11 @@ func init() {
 
 func TestRequest(t *testing.T) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", &config.Configuration{}, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 
-	bs, err := m.Request(node1, "default", "foo", 0, 6)
+	bs, err := m.Request(node1, "default", "foo", 0, 6, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,7 +75,7 @@ func TestRequest(t *testing.T) {
 		t.Errorf("Incorrect data from request: %q", string(bs))
 	}
 
-	bs, err = m.Request(node1, "default", "../walk.go", 0, 6)
+	bs, err = m.Request(node1, "default", "../walk.go", 0, 6, 0)
 	if err == nil {
 		t.Error("Unexpected nil error on insecure file read")
 	}
@@ -94,7 +100,7 @@ func genFiles(n int) []protocol.FileInfo {
 
 func BenchmarkIndex10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -107,7 +113,7 @@ func BenchmarkIndex10000(b *testing.B) {
 
 func BenchmarkIndex00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(100)
@@ -120,7 +126,7 @@ func BenchmarkIndex00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -134,7 +140,7 @@ func BenchmarkIndexUpdate10000f10000(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -149,7 +155,7 @@ func BenchmarkIndexUpdate10000f00100(b *testing.B) {
 
 func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 	files := genFiles(10000)
@@ -195,8 +201,14 @@ func (f FakeConnection) Request(repo, name string, offset int64, size int) ([]by
 	return f.requestData, nil
 }
 
+func (f FakeConnection) RequestDeadline(repo, name string, offset int64, size int, flags uint32, deadline time.Time, cancel <-chan struct{}) ([]byte, error) {
+	return f.requestData, nil
+}
+
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (FakeConnection) DownloadProgress(string, []protocol.FileDownloadProgress) {}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
@@ -207,7 +219,7 @@ func (FakeConnection) Statistics() protocol.Statistics {
 
 func BenchmarkRequest(b *testing.B) {
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", nil, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", nil, node0, "node", "syncthing", "dev", db)
 	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
 	m.ScanRepo("default")
 
@@ -231,7 +243,7 @@ func BenchmarkRequest(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		data, err := m.requestGlobal(node1, "default", files[i%n].Name, 0, 32, nil)
+		data, err := m.requestGlobal(node1, "default", files[i%n].Name, 0, 32, nil, 0, time.Minute)
 		if err != nil {
 			b.Error(err)
 		}
@@ -246,16 +258,47 @@ func TestActivityMap(t *testing.T) {
 		return true
 	}
 	m := make(activityMap)
-	if node := m.leastBusyNode([]protocol.NodeID{node1}, isValid); node != node1 {
+	if node := m.leastBusyNode([]protocol.NodeID{node1}, isValid, nil); node != node1 {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode([]protocol.NodeID{node2}, isValid); node != node2 {
+	if node := m.leastBusyNode([]protocol.NodeID{node2}, isValid, nil); node != node2 {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode([]protocol.NodeID{node1, node2}, isValid); node != node1 {
+	if node := m.leastBusyNode([]protocol.NodeID{node1, node2}, isValid, nil); node != node1 {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
-	if node := m.leastBusyNode([]protocol.NodeID{node1, node2}, isValid); node != node2 {
+	if node := m.leastBusyNode([]protocol.NodeID{node1, node2}, isValid, nil); node != node2 {
+		t.Errorf("Incorrect least busy node %q", node)
+	}
+}
+
+func TestActivityMapLatency(t *testing.T) {
+	isValid := func(protocol.NodeID) bool {
+		return true
+	}
+	latency := func(node protocol.NodeID) time.Duration {
+		switch node {
+		case node1:
+			return 10 * time.Millisecond
+		case node2:
+			return 40 * time.Millisecond
+		}
+		return 0
+	}
+
+	m := make(activityMap)
+	var got = make(map[protocol.NodeID]int)
+	for i := 0; i < 5; i++ {
+		got[m.leastBusyNode([]protocol.NodeID{node1, node2}, isValid, latency)]++
+	}
+	if got[node1] != 4 || got[node2] != 1 {
+		t.Errorf("Incorrect distribution of requests %v", got)
+	}
+
+	// Unknown latency is taken to be the average of the known ones
+	m = make(activityMap)
+	m[node0] = 1
+	if node := m.leastBusyNode([]protocol.NodeID{node0, node2}, isValid, latency); node != node2 {
 		t.Errorf("Incorrect least busy node %q", node)
 	}
 }
@@ -274,7 +317,7 @@ func TestNodeRename(t *testing.T) {
 	}
 
 	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
-	m := NewModel("/tmp", &cfg, "node", "syncthing", "dev", db)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
 	if cfg.Nodes[0].Name != "" {
 		t.Errorf("Node already has a name")
 	}
@@ -301,3 +344,1195 @@ func TestNodeRename(t *testing.T) {
 		t.Errorf("Node name got overwritten")
 	}
 }
+
+func TestClusterConfigMaxLocalVersion(t *testing.T) {
+	cfg := config.New("test", node0)
+	cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.RepositoryNodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	})
+
+	// The index the peer sends comes from the index it announced
+	m.ClusterConfig(node1, protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{{ID: "default"}},
+		Options:      []protocol.Option{{Key: indexIDOption(0), Value: "7 0"}},
+	})
+	files := genFiles(3)
+	for i := range files {
+		files[i].Version = 1
+		files[i].LocalVersion = uint64(40 + i)
+	}
+	m.Index(node1, "default", files)
+
+	cm := m.clusterConfig(node1)
+	myIndexID := m.repoFiles["default"].IndexID(protocol.LocalNodeID)
+	if own, ours := indexIDs(cm, "default"); own != myIndexID || ours != 7 {
+		t.Errorf("Incorrect index IDs %x, %x != %x, 7", own, ours, myIndexID)
+	}
+	if l := len(cm.Repositories); l != 1 {
+		t.Fatalf("Incorrect number of repositories %d != 1", l)
+	}
+	r := cm.Repositories[0]
+	if l := len(r.Nodes); l != 2 {
+		t.Fatalf("Incorrect number of nodes %d != 2", l)
+	}
+	if id := r.Nodes[0].ID; bytes.Compare(id, node0[:]) != 0 {
+		t.Errorf("Incorrect node ID %x != %x", id, node0)
+	}
+	if v := r.Nodes[0].MaxLocalVersion; v != 0 {
+		t.Errorf("Incorrect max local version for ourselves %d != 0", v)
+	}
+	if v := r.Nodes[1].MaxLocalVersion; v != 42 {
+		t.Errorf("Incorrect max local version for peer %d != 42", v)
+	}
+}
+
+func TestIndexStartVersion(t *testing.T) {
+	cc := protocol.ClusterConfigMessage{
+		Repositories: []protocol.Repository{
+			{
+				ID: "default",
+				Nodes: []protocol.Node{
+					{ID: node1[:], MaxLocalVersion: 100},
+					{ID: node0[:], MaxLocalVersion: 50},
+				},
+			},
+			{
+				ID: "legacy",
+				Nodes: []protocol.Node{
+					{ID: node0[:], MaxLocalVersion: 50},
+				},
+			},
+		},
+		Options: []protocol.Option{{Key: indexIDOption(0), Value: "3 2a"}},
+	}
+
+	cases := []struct {
+		repo    string
+		indexID uint64
+		curVer  uint64
+		start   uint64
+	}{
+		{"default", 42, 60, 50},
+		{"default", 42, 50, 50},
+		{"default", 42, 40, 0}, // the peer claims to know more than we have
+		{"default", 43, 60, 0}, // our database was reset
+		{"legacy", 42, 60, 0},  // no index ID from the peer
+		{"other", 42, 60, 0},   // repo unknown to the peer
+	}
+
+	for i, tc := range cases {
+		if s := indexStartVersion(cc, tc.repo, node0, tc.indexID, tc.curVer); s != tc.start {
+			t.Errorf("%d: incorrect start version %d != %d", i, s, tc.start)
+		}
+	}
+}
+
+type indexRecorder struct {
+	FakeConnection
+	mut     sync.Mutex
+	indexes []int // number of files per message; negative for Index Update
+}
+
+func (r *indexRecorder) Index(repo string, fs []protocol.FileInfo) error {
+	r.mut.Lock()
+	r.indexes = append(r.indexes, len(fs))
+	r.mut.Unlock()
+	return nil
+}
+
+func (r *indexRecorder) IndexUpdate(repo string, fs []protocol.FileInfo) error {
+	r.mut.Lock()
+	r.indexes = append(r.indexes, -len(fs))
+	r.mut.Unlock()
+	return nil
+}
+
+func (r *indexRecorder) sent() []int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]int(nil), r.indexes...)
+}
+
+func TestSendIndexDelta(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+	m.ScanRepo("default")
+	fs := m.repoFiles["default"]
+
+	var versions []uint64
+	fs.WithHave(protocol.LocalNodeID, func(f protocol.FileIntf) bool {
+		versions = append(versions, f.(protocol.FileInfo).LocalVersion)
+		return true
+	})
+	if len(versions) < 2 {
+		t.Fatal("Too few files in test data")
+	}
+	maxVer := fs.LocalVersion(protocol.LocalNodeID)
+
+	// A full index
+	r := &indexRecorder{FakeConnection: FakeConnection{id: node1}}
+	ver, err := sendIndexTo(true, 0, r, "default", fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != maxVer {
+		t.Errorf("Incorrect max version %d != %d", ver, maxVer)
+	}
+	if len(r.indexes) != 1 || r.indexes[0] != len(versions) {
+		t.Errorf("Incorrect full index %v", r.indexes)
+	}
+
+	// Only the newest file, as an Index Update
+	r = &indexRecorder{FakeConnection: FakeConnection{id: node1}}
+	ver, err = sendIndexTo(true, maxVer-1, r, "default", fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != maxVer {
+		t.Errorf("Incorrect max version %d != %d", ver, maxVer)
+	}
+	if len(r.indexes) != 1 || r.indexes[0] != -1 {
+		t.Errorf("Incorrect delta index %v", r.indexes)
+	}
+
+	// Nothing new, but we still need to send an (empty) Index Update
+	r = &indexRecorder{FakeConnection: FakeConnection{id: node1}}
+	ver, err = sendIndexTo(true, maxVer, r, "default", fs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != maxVer {
+		t.Errorf("Incorrect max version %d != %d", ver, maxVer)
+	}
+	if len(r.indexes) != 1 || r.indexes[0] != 0 {
+		t.Errorf("Incorrect empty delta index %v", r.indexes)
+	}
+}
+
+func TestSharedReadOnly(t *testing.T) {
+	cfg := config.New("test", node0)
+	cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}, {NodeID: node2}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.RepositoryNodeConfiguration{{NodeID: node0}, {NodeID: node1}, {NodeID: node2}},
+	})
+	m.ScanRepo("default")
+
+	// node1 doesn't accept our changes, node2 does
+	cc := func(flags uint32) protocol.ClusterConfigMessage {
+		return protocol.ClusterConfigMessage{
+			Repositories: []protocol.Repository{{
+				ID:    "default",
+				Nodes: []protocol.Node{{ID: node0[:], Flags: flags}},
+			}},
+		}
+	}
+	ro := &indexRecorder{FakeConnection: FakeConnection{id: node1}}
+	m.AddConnection(ro, ro)
+	m.ClusterConfig(node1, cc(protocol.FlagShareReadOnly))
+	rw := &indexRecorder{FakeConnection: FakeConnection{id: node2}}
+	m.AddConnection(rw, rw)
+	m.ClusterConfig(node2, cc(protocol.FlagShareTrusted))
+
+	time.Sleep(100 * time.Millisecond)
+
+	if idx := ro.sent(); len(idx) != 1 || idx[0] != 0 {
+		t.Errorf("Incorrect index sent to read only peer %v", idx)
+	}
+	if idx := rw.sent(); len(idx) != 1 || idx[0] == 0 {
+		t.Errorf("Incorrect index sent to trusted peer %v", idx)
+	}
+}
+
+func TestReadOnlyNode(t *testing.T) {
+	cfg := config.New("test", node0)
+	cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}, {NodeID: node2}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		ReadOnly:  true,
+		Nodes: []config.RepositoryNodeConfiguration{
+			{NodeID: node0},
+			{NodeID: node1, ReadOnly: true},
+			{NodeID: node2},
+		},
+	})
+
+	cm := m.clusterConfig(node1)
+	expected := []uint32{protocol.FlagShareReadOnly, protocol.FlagShareReadOnly, protocol.FlagShareTrusted}
+	for i, n := range cm.Repositories[0].Nodes {
+		if n.Flags != expected[i] {
+			t.Errorf("Incorrect flags %x != %x for node %d", n.Flags, expected[i], i)
+		}
+	}
+
+	files := genFiles(10)
+	m.Index(node1, "default", files)
+	m.IndexUpdate(node1, "default", files)
+	m.Index(node2, "default", files[:5])
+
+	if l := len(m.repoFiles["default"].Availability(files[0].Name)); l != 1 {
+		t.Errorf("Index from read only node should be ignored; %d nodes have the file", l)
+	}
+	if l := len(m.repoFiles["default"].Availability(files[9].Name)); l != 0 {
+		t.Errorf("Index update from read only node should be ignored; %d nodes have the file", l)
+	}
+}
+
+func TestIndexExchange(t *testing.T) {
+	repoCfg := config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes:     []config.RepositoryNodeConfiguration{{NodeID: node0}, {NodeID: node1}},
+	}
+
+	newModel := func(myID protocol.NodeID) *Model {
+		cfg := config.New("test", myID)
+		cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}}
+		db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+		m := NewModel("/tmp", &cfg, myID, "node", "syncthing", "dev", db)
+		m.AddRepo(repoCfg)
+		return m
+	}
+
+	m0 := newModel(node0)
+	m1 := newModel(node1)
+	m1.ScanRepo("default")
+	var local int
+	m1.repoFiles["default"].WithHave(protocol.LocalNodeID, func(protocol.FileIntf) bool {
+		local++
+		return true
+	})
+
+	p := testutil.NewPair(node0, m0, node1, m1, protocol.DefaultCompression, testutil.Faults{Latency: time.Millisecond})
+	defer p.Close()
+	m0.AddConnection(p, p.Conn0)
+	m1.AddConnection(p, p.Conn1)
+
+	var remote int
+	for t0 := time.Now(); time.Since(t0) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		remote = 0
+		m0.repoFiles["default"].WithHave(node1, func(protocol.FileIntf) bool {
+			remote++
+			return true
+		})
+		if remote == local {
+			break
+		}
+	}
+	if remote != local {
+		t.Errorf("Incorrect number of files received %d != %d", remote, local)
+	}
+}
+
+func TestDownloadSources(t *testing.T) {
+	cfg := config.New("test", node0)
+	cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}, {NodeID: node2}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{
+		ID:        "default",
+		Directory: "testdata",
+		Nodes: []config.RepositoryNodeConfiguration{
+			{NodeID: node0},
+			{NodeID: node1},
+			{NodeID: node2, ReadOnly: true},
+		},
+	})
+
+	progress := []protocol.FileDownloadProgress{{Name: "foo", Version: 2, Blocks: []uint32{0, 2}}}
+	m.DownloadProgress(node1, "default", progress)
+	m.DownloadProgress(node2, "default", progress)
+
+	f := protocol.FileInfo{Name: "foo", Version: 2}
+	if nodes := m.downloadSources("default", f, 2); len(nodes) != 1 || nodes[0] != node1 {
+		t.Errorf("Incorrect sources %v for block 2", nodes)
+	}
+	if nodes := m.downloadSources("default", f, 1); len(nodes) != 0 {
+		t.Errorf("Incorrect sources %v for missing block", nodes)
+	}
+	f.Version = 3
+	if nodes := m.downloadSources("default", f, 2); len(nodes) != 0 {
+		t.Errorf("Incorrect sources %v for other version", nodes)
+	}
+
+	f.Version = 2
+	m.Close(node1, errors.New("test"))
+	if nodes := m.downloadSources("default", f, 2); len(nodes) != 0 {
+		t.Errorf("Incorrect sources %v after disconnect", nodes)
+	}
+}
+
+func TestRequestTemporary(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	fd, err := ioutil.TempFile("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteAt([]byte("second"), protocol.BlockSize)
+	fd.Close()
+
+	m.downloads.started("default", "foo", 2, fd.Name(), nil)
+	m.downloads.gotBlock("default", "foo", 1)
+
+	bs, err := m.Request(node1, "default", "foo", protocol.BlockSize, 6, protocol.FlagRequestTemporary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "second" {
+		t.Errorf("Incorrect data from temporary file: %q", bs)
+	}
+
+	if _, err := m.Request(node1, "default", "foo", 0, 6, protocol.FlagRequestTemporary); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v for block not yet downloaded", err)
+	}
+
+	if progress := m.downloads.changes()["default"]; len(progress) != 1 || len(progress[0].Blocks) != 1 || progress[0].Blocks[0] != 1 {
+		t.Errorf("Incorrect download progress %v", progress)
+	}
+
+	m.downloads.finished("default", "foo")
+	if _, err := m.Request(node1, "default", "foo", protocol.BlockSize, 6, protocol.FlagRequestTemporary); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v for finished download", err)
+	}
+	if progress, ok := m.downloads.changes()["default"]; !ok || len(progress) != 0 {
+		t.Errorf("Finished download should be sent as an empty list, not %v", progress)
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	when := time.Date(2014, 8, 12, 13, 14, 15, 0, time.Local)
+	name := conflictName("dir/file.txt", when, node1)
+
+	c, ok := parseConflictName(name)
+	if !ok {
+		t.Fatalf("Conflict name %q not recognized", name)
+	}
+	if c.Original != "dir/file.txt" {
+		t.Errorf("Incorrect original name %q", c.Original)
+	}
+	if !c.Time.Equal(when) {
+		t.Errorf("Incorrect time %v != %v", c.Time, when)
+	}
+	if c.Node != node1.String()[:7] {
+		t.Errorf("Incorrect node %q", c.Node)
+	}
+
+	for _, name := range []string{"file.txt", "file.sync-conflict-20140812-131415", ".sync-conflict-20140812-131415-AIR6LPZ"} {
+		if _, ok := parseConflictName(name); ok {
+			t.Errorf("%q should not be a conflict name", name)
+		}
+	}
+}
+
+func TestRenamedFrom(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	blocks := []protocol.BlockInfo{{Size: 4, Hash: []byte("0123456789abcdef0123456789abcdef")}}
+	m.updateLocal("default", protocol.FileInfo{Name: "gone", Version: 1, Blocks: blocks})
+	m.updateLocal("default", protocol.FileInfo{Name: "foo", Version: 1, Blocks: blocks})
+
+	nf := protocol.FileInfo{Name: "new", Version: 2, Blocks: blocks}
+	df, ok := m.renamedFrom("default", "testdata", nf, nil)
+	if !ok {
+		t.Fatal("Rename not detected")
+	}
+	if df.Name != "gone" || !df.IsDeleted() {
+		t.Errorf("Incorrect deleted file %v", df)
+	}
+
+	// "foo" still exists on disk and can't be the source
+	if _, ok := m.renamedFrom("default", "testdata", nf, map[string]bool{"gone": true}); ok {
+		t.Error("Rename from existing file")
+	}
+
+	nf.Blocks = []protocol.BlockInfo{{Size: 4, Hash: []byte("fedcba9876543210fedcba9876543210")}}
+	if _, ok := m.renamedFrom("default", "testdata", nf, nil); ok {
+		t.Error("Rename from file with different blocks")
+	}
+
+	// The first block recurs later in the file, as with zero filled data,
+	// so the block map records it at a later offset
+	zeros := protocol.BlockInfo{Size: 4, Hash: []byte("00000000000000000000000000000000")}
+	blocks = []protocol.BlockInfo{zeros, blocks[0], zeros}
+	m.updateLocal("default", protocol.FileInfo{Name: "zeros", Version: 1, Blocks: blocks})
+	nf = protocol.FileInfo{Name: "zeros.new", Version: 2, Blocks: blocks}
+	if df, ok := m.renamedFrom("default", "testdata", nf, nil); !ok || df.Name != "zeros" {
+		t.Errorf("Rename of file with a recurring first block not detected; %v", df)
+	}
+}
+
+func TestNeededFilesLargeRename(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: "testdata"})
+
+	// More files are moved than fit in a batch
+	var local, global []protocol.FileInfo
+	for i := 0; i <= indexBatchSize; i++ {
+		blocks := []protocol.BlockInfo{{Size: 4, Hash: []byte(fmt.Sprintf("%032d", i))}}
+		local = append(local, protocol.FileInfo{Name: fmt.Sprintf("old/%04d", i), Version: 1, Blocks: blocks})
+		global = append(global,
+			protocol.FileInfo{Name: fmt.Sprintf("new/%04d", i), Version: 2, Blocks: blocks},
+			protocol.FileInfo{Name: fmt.Sprintf("old/%04d", i), Version: 2, Flags: protocol.FlagDeleted})
+	}
+	m.repoFiles["default"].ReplaceWithDelete(protocol.LocalNodeID, local, node0.Short())
+	m.repoFiles["default"].Replace(node1, global)
+
+	p := &puller{repoCfg: config.RepositoryConfiguration{ID: "default", Directory: "testdata"}, model: m}
+	files := p.neededFiles(func(string, uint64) bool { return false })
+	names := make(map[string]bool)
+	for _, f := range files {
+		names[f.Name] = true
+	}
+	if len(files) != 2*indexBatchSize {
+		t.Errorf("Incorrect number of needed files %d != %d", len(files), 2*indexBatchSize)
+	}
+	for i := 0; i < indexBatchSize; i++ {
+		if !names[fmt.Sprintf("new/%04d", i)] || !names[fmt.Sprintf("old/%04d", i)] {
+			t.Fatalf("File %d should be pulled together with the file it was renamed from", i)
+		}
+	}
+}
+
+func TestRetryWaitsForWindow(t *testing.T) {
+	cfg := config.Configuration{}
+	cfg.Options.MinRequestWindow = 1
+	cfg.Options.MaxRequestWindow = 1
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: "testdata"}
+	m.AddRepo(repoCfg)
+	fc := FakeConnection{id: node2}
+	m.AddConnection(fc, fc)
+
+	p := &puller{
+		repoCfg:           repoCfg,
+		model:             m,
+		oustandingPerNode: make(activityMap),
+		openFiles:         make(map[string]openFile),
+		requestResults:    make(chan requestResult, 1),
+	}
+	blocks := []protocol.BlockInfo{{Size: 4, Hash: []byte("0123456789abcdef0123456789abcdef")}}
+	f := protocol.FileInfo{Name: "file", Version: 1, Blocks: blocks}
+	p.openFiles["file"] = openFile{availability: []protocol.NodeID{node1, node2}, outstanding: 1, done: true}
+	p.oustandingPerNode[node1] = 1
+	p.oustandingPerNode[node2] = 1
+
+	p.handleRequestResult(requestResult{node: node1, file: f, size: 4, err: protocol.ErrTimeout})
+	b, ok := p.bq.get()
+	if !ok || b.file.Name != "file" || !b.last || len(b.tried) != 1 || b.tried[0] != node1 {
+		t.Fatalf("Failed block should be queued again, got %v", b)
+	}
+	if of := p.openFiles["file"]; of.outstanding != 0 || of.done || of.err != nil {
+		t.Errorf("Incorrect open file after retry %v", of)
+	}
+
+	// The window of node2 is full, so the block waits for room
+	if !p.handleRequestBlock(b) || !p.busy {
+		t.Error("Retried block should wait for a request window with room")
+	}
+	if p.oustandingPerNode[node2] != 1 {
+		t.Errorf("Retry exceeded the request window of the node; %d outstanding", p.oustandingPerNode[node2])
+	}
+	if b, ok := p.bq.get(); !ok || len(b.tried) != 1 {
+		t.Errorf("Retried block should stay queued, got %v", b)
+	}
+}
+
+func TestFailureBackoff(t *testing.T) {
+	ft := newFailureTracker()
+	f := protocol.FileInfo{Name: "foo", Version: 1}
+	now := time.Now()
+
+	if !ft.retry("default", "foo", 1, now) {
+		t.Error("File that has not failed should be tried")
+	}
+
+	item := ft.failed("default", f, errHashMismatch, now)
+	if item.Attempts != 1 || item.Retry != now.Add(retryMinDelay) || item.Error != errHashMismatch.Error() {
+		t.Errorf("Incorrect first failure %+v", item)
+	}
+	if ft.retry("default", "foo", 1, now) {
+		t.Error("Failed file should not be retried at once")
+	}
+	if !ft.retry("default", "foo", 2, now) {
+		t.Error("New version of failed file should be tried")
+	}
+	if !ft.due("default", now.Add(retryMinDelay)) {
+		t.Error("Failed file should be due for retry")
+	}
+	if ft.due("default", now.Add(retryMinDelay)) {
+		t.Error("Failed file should be due only once")
+	}
+
+	item = ft.failed("default", f, errHashMismatch, now)
+	if item.Attempts != 2 || item.Retry != now.Add(2*retryMinDelay) {
+		t.Errorf("Incorrect second failure %+v", item)
+	}
+	for i := 0; i < 10; i++ {
+		item = ft.failed("default", f, errHashMismatch, now)
+	}
+	if item.Retry != now.Add(retryMaxDelay) {
+		t.Errorf("Retry delay %v not capped", item.Retry.Sub(now))
+	}
+
+	f.Version = 2
+	if item = ft.failed("default", f, errHashMismatch, now); item.Attempts != 1 {
+		t.Errorf("Failure of new version should reset attempts, not %d", item.Attempts)
+	}
+
+	if items := ft.items("default"); len(items) != 1 || items[0].Name != "foo" {
+		t.Errorf("Incorrect failed items %v", items)
+	}
+	ft.succeeded("default", "foo")
+	if items := ft.items("default"); len(items) != 0 {
+		t.Errorf("Incorrect failed items after success %v", items)
+	}
+}
+
+func TestVerifyBlocks(t *testing.T) {
+	data := make([]byte, 3*protocol.BlockSize)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize, int64(len(data)))
+
+	fd, err := ioutil.TempFile("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	// An interrupted download with the second block missing and the third
+	// block only partly written
+	partial := append([]byte(nil), data[:len(data)-10]...)
+	for i := protocol.BlockSize; i < 2*protocol.BlockSize; i++ {
+		partial[i] = 0
+	}
+	fd.Write(partial)
+
+	verified := func(stop chan struct{}) []uint32 {
+		var have []uint32
+		verifyBlocks(fd, blocks, stop, func(index uint32) {
+			have = append(have, index)
+		})
+		return have
+	}
+
+	have := verified(nil)
+	if len(have) != 1 || have[0] != 0 {
+		t.Errorf("Incorrect verified blocks %v", have)
+	}
+
+	fd.WriteAt(data, 0)
+	have = verified(nil)
+	if len(have) != 3 {
+		t.Errorf("Incorrect verified blocks %v", have)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	if have = verified(stop); len(have) != 0 {
+		t.Errorf("Blocks verified after stopping %v", have)
+	}
+
+	have = nil
+	v := verifyTemp(fd.Name(), blocks, func(index uint32) {
+		have = append(have, index)
+	})
+	<-v.done
+	v.cancel()
+	if len(have) != 3 {
+		t.Errorf("Incorrect blocks verified in the background %v", have)
+	}
+}
+
+func TestBlockRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	record := blockRecordName(dir + "/file")
+	if !defTempNamer.IsTemporary(record) {
+		t.Errorf("Block record %q should be a temporary file", record)
+	}
+
+	fd, blocks, found, err := openBlockRecord(record, 5, false)
+	if err != nil || found || len(blocks) != 0 {
+		t.Fatalf("Incorrect new record %v, %v, %v", blocks, found, err)
+	}
+	recordBlock(fd, 3)
+	recordBlock(fd, 1)
+	fd.Close()
+
+	fd, blocks, found, err = openBlockRecord(record, 5, true)
+	if err != nil || !found || fmt.Sprint(blocks) != "[3 1]" {
+		t.Fatalf("Incorrect resumed record %v, %v, %v", blocks, found, err)
+	}
+	recordBlock(fd, 2)
+	fd.Write([]byte{0, 0}) // interrupted while recording a block
+	fd.Close()
+
+	fd, blocks, found, err = openBlockRecord(record, 5, true)
+	if err != nil || !found || fmt.Sprint(blocks) != "[3 1 2]" {
+		t.Fatalf("Incorrect resumed record %v, %v, %v", blocks, found, err)
+	}
+	fd.Close()
+
+	// Another version of the file, or no temporary file to resume
+	for _, resume := range []struct {
+		version  uint64
+		resuming bool
+	}{{6, true}, {5, false}} {
+		fd, blocks, found, err = openBlockRecord(record, resume.version, resume.resuming)
+		if err != nil || found || len(blocks) != 0 {
+			t.Errorf("Incorrect record for %v: %v, %v, %v", resume, blocks, found, err)
+		}
+		recordBlock(fd, 1)
+		fd.Close()
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	repoCfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m.AddRepo(repoCfg)
+
+	data := make([]byte, 2*protocol.BlockSize)
+	for i := range data {
+		data[i] = byte(i / 7)
+	}
+	blocks, _ := scanner.Blocks(bytes.NewReader(data), scanner.StandardBlockSize, int64(len(data)))
+	f := protocol.FileInfo{Name: "file", Version: 2, Blocks: blocks}
+	temp := dir + "/" + defTempNamer.TempName("file")
+
+	// Opens the file for pulling; there is no source for the block
+	open := func() *puller {
+		p := &puller{
+			repoCfg:           repoCfg,
+			model:             m,
+			oustandingPerNode: make(activityMap),
+			openFiles:         make(map[string]openFile),
+		}
+		p.handleBlock(bqBlock{file: f, block: blocks[1], first: true})
+		return p
+	}
+	have := func() (have []bool) {
+		for i := range blocks {
+			_, ok := m.downloads.temporary("default", "file", uint32(i))
+			have = append(have, ok)
+		}
+		return have
+	}
+
+	// A new download is not verified
+	p := open()
+	if p.openFiles["file"].verifier != nil {
+		t.Error("New temporary file should not be verified")
+	}
+	p.forgetFile("file")
+
+	// A temporary file without a record for the version is verified in
+	// the background
+	ioutil.WriteFile(temp, data[:protocol.BlockSize], 0644)
+	os.Remove(blockRecordName(dir + "/file"))
+	p = open()
+	of := p.openFiles["file"]
+	if of.verifier == nil {
+		t.Fatal("Temporary file without a record should be verified")
+	}
+	<-of.verifier.done
+	if h := have(); !h[0] || h[1] {
+		t.Errorf("Incorrect blocks verified in the background %v", h)
+	}
+	p.forgetFile("file")
+
+	// The verified block was recorded, so resuming again needs no hashing
+	p = open()
+	if p.openFiles["file"].verifier != nil {
+		t.Error("Temporary file with a record should not be verified")
+	}
+	if h := have(); !h[0] || h[1] {
+		t.Errorf("Incorrect recorded blocks %v", h)
+	}
+	p.forgetFile("file")
+}
+
+func TestNeededBatch(t *testing.T) {
+	fs := []protocol.FileInfoTruncated{
+		{Name: "a.bin", Modified: 3, NumBlocks: 1},
+		{Name: "b.log", Modified: 1, NumBlocks: 3},
+		{Name: "c.bin", Modified: 2, NumBlocks: 2},
+		{Name: "d.log", Modified: 4, NumBlocks: 4},
+	}
+	names := func(max int, order string, ps priorities) []string {
+		b := newNeededBatch(max, order, ps)
+		for _, f := range fs {
+			b.add(f)
+		}
+		var ns []string
+		for _, f := range b.sorted() {
+			ns = append(ns, f.Name)
+		}
+		return ns
+	}
+
+	var tests = []struct {
+		order string
+		names []string
+	}{
+		{"", []string{"a.bin", "b.log", "c.bin", "d.log"}},
+		{config.OrderAlphabetic, []string{"a.bin", "b.log", "c.bin", "d.log"}},
+		{config.OrderSmallestFirst, []string{"a.bin", "c.bin", "b.log", "d.log"}},
+		{config.OrderLargestFirst, []string{"d.log", "b.log", "c.bin", "a.bin"}},
+		{config.OrderOldestFirst, []string{"b.log", "c.bin", "a.bin", "d.log"}},
+		{config.OrderNewestFirst, []string{"d.log", "a.bin", "c.bin", "b.log"}},
+	}
+	for _, tc := range tests {
+		if ns := names(len(fs), tc.order, nil); fmt.Sprint(ns) != fmt.Sprint(tc.names) {
+			t.Errorf("Order %s: incorrect order %v != %v", tc.order, ns, tc.names)
+		}
+		if ns := names(2, tc.order, nil); fmt.Sprint(ns) != fmt.Sprint(tc.names[:2]) {
+			t.Errorf("Order %s: incorrect limited order %v != %v", tc.order, ns, tc.names[:2])
+		}
+	}
+
+	fd, err := ioutil.TempFile("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("*.log\n\nc.bin\n")
+	fd.Close()
+	ps, err := loadPriorities(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, exp := names(len(fs), config.OrderAlphabetic, ps), []string{"b.log", "d.log", "c.bin", "a.bin"}; fmt.Sprint(ns) != fmt.Sprint(exp) {
+		t.Errorf("Incorrect order with priorities %v != %v", ns, exp)
+	}
+	if ns := names(len(fs), config.OrderRandom, ps); ns[2] != "c.bin" || ns[3] != "a.bin" {
+		t.Errorf("Incorrect random order with priorities %v", ns)
+	}
+	if ns := names(3, config.OrderRandom, ps); len(ns) != 3 || ns[2] != "c.bin" {
+		t.Errorf("Incorrect limited random order with priorities %v", ns)
+	}
+}
+
+func TestCurrentPriorities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &puller{repoCfg: config.RepositoryConfiguration{ID: "default", Directory: dir}}
+	if ps := p.currentPriorities(); ps != nil {
+		t.Errorf("Unexpected priorities %v without a priority file", ps)
+	}
+
+	file := dir + "/" + priorityFile
+	ioutil.WriteFile(file, []byte("*.log\n"), 0644)
+	mod := time.Unix(1400000000, 0)
+	os.Chtimes(file, mod, mod)
+	if ps := p.currentPriorities(); len(ps) != 1 {
+		t.Fatalf("Incorrect priorities %v", ps)
+	}
+
+	// Not parsed again while unmodified
+	p.priorities = append(p.priorities, nil)
+	if ps := p.currentPriorities(); len(ps) != 2 {
+		t.Errorf("Priorities were parsed again; %v", ps)
+	}
+
+	ioutil.WriteFile(file, []byte("*.log\n*.bin\n*.txt\n"), 0644)
+	if ps := p.currentPriorities(); len(ps) != 3 {
+		t.Errorf("Modified priorities were not parsed again; %v", ps)
+	}
+
+	os.Remove(file)
+	if ps := p.currentPriorities(); ps != nil {
+		t.Errorf("Unexpected priorities %v after removing the priority file", ps)
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	p := &puller{
+		repoCfg:    config.RepositoryConfiguration{ID: "default", Directory: "testdata", MaxSizeMiB: 1},
+		localBytes: 512 << 10,
+	}
+	if err := p.checkSpace(256<<10, 256<<10); err != nil {
+		t.Error("Unexpected error within quota:", err)
+	}
+	if err := p.checkSpace(768<<10, 768<<10); err == nil {
+		t.Error("Expected error beyond quota")
+	}
+	if err := p.checkSpace(768<<10, -256<<10); err != nil {
+		t.Error("Unexpected error for shrinking file:", err)
+	}
+
+	p.repoCfg.MinDiskFreeMiB = 1 << 40
+	if err := p.checkSpace(0, 0); err == nil {
+		t.Error("Expected error for too little free disk space")
+	}
+}
+
+func TestPauseRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := config.New(dir+"/config.xml", node0)
+	cfg.Nodes = []config.NodeConfiguration{{NodeID: node0}, {NodeID: node1}}
+	cfg.Repositories = []config.RepositoryConfiguration{{ID: "default", Directory: "testdata"}}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &cfg, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(cfg.Repositories[0])
+
+	m.setState("default", RepoOutOfSpace)
+	if err := m.PauseRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ResumeRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := m.State("default"); state != "outofspace" {
+		t.Errorf("Resumed repository should be out of space as before, not %q", state)
+	}
+
+	if err := m.PauseRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if !m.RepoPaused("default") || !cfg.Repositories[0].Paused {
+		t.Error("Repository should be paused")
+	}
+	if err := m.ScanRepo("default"); err != ErrRepoPaused {
+		t.Errorf("Incorrect error scanning paused repository: %v", err)
+	}
+	m.setState("default", RepoSyncing)
+	if state, _ := m.State("default"); state != "paused" {
+		t.Errorf("Incorrect state %q for paused repository", state)
+	}
+
+	if err := m.ResumeRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := m.State("default"); state != "syncing" || m.RepoPaused("default") || cfg.Repositories[0].Paused {
+		t.Errorf("Repository should be resumed and syncing, not %q", state)
+	}
+	if err := m.PauseRepo("nonexistent"); err == nil {
+		t.Error("Unexpected nil error pausing nonexistent repository")
+	}
+
+	if err := m.PauseNode(node1); err != nil {
+		t.Fatal(err)
+	}
+	if !m.NodePaused(node1) || !cfg.Nodes[1].Paused {
+		t.Error("Node should be paused")
+	}
+	if err := m.ResumeNode(node1); err != nil || m.NodePaused(node1) {
+		t.Error("Node should be resumed;", err)
+	}
+	if err := m.PauseNode(node2); err == nil {
+		t.Error("Unexpected nil error pausing unknown node")
+	}
+}
+
+func TestReceiveOnlyRevert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir, ReceiveOnly: true})
+
+	blocks := []protocol.BlockInfo{{Size: 4, Hash: []byte("0123456789abcdef0123456789abcdef")}}
+	m.repoFiles["default"].Replace(node1, []protocol.FileInfo{{Name: "global", Version: 1, Modified: 1, Blocks: blocks}})
+	m.updateLocal("default", protocol.FileInfo{Name: "global", Version: 1, Modified: 1, Blocks: blocks})
+
+	ioutil.WriteFile(dir+"/global", []byte("changed"), 0644)
+	ioutil.WriteFile(dir+"/local", []byte("local"), 0644)
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := m.LocalChanges("default")
+	if len(changes) != 2 || changes[0].Name != "global" || changes[1].Name != "local" {
+		t.Fatalf("Incorrect local changes %v", changes)
+	}
+	if gf := m.repoFiles["default"].GetGlobal("global"); gf.Version != 1 {
+		t.Errorf("Local change should not affect the global version, got %v", gf)
+	}
+	if !m.localChange("default", "global") {
+		t.Error("Changed file should be left alone by the puller")
+	}
+
+	if err := m.Revert("default"); err != nil {
+		t.Fatal(err)
+	}
+	if changes := m.LocalChanges("default"); len(changes) != 0 {
+		t.Errorf("Incorrect local changes after revert %v", changes)
+	}
+	if _, err := os.Stat(dir + "/local"); !os.IsNotExist(err) {
+		t.Error("Local file should have been removed")
+	}
+	if m.localChange("default", "global") {
+		t.Error("Reverted file should be pulled")
+	}
+	if lf := m.CurrentRepoFile("default", "global"); lf.Version != 0 || lf.IsInvalid() || !lf.Vector.IsEmpty() {
+		t.Errorf("Incorrect local entry after revert %v", lf)
+	}
+	p := &puller{repoCfg: config.RepositoryConfiguration{ID: "default", Directory: dir, ReceiveOnly: true}, model: m}
+	need := p.neededFiles(func(string, uint64) bool { return false })
+	if len(need) != 1 || need[0].Name != "global" || need[0].Version != 1 {
+		t.Errorf("Global version should be pulled again after revert, need %v", need)
+	}
+	if err := m.Revert("nonexistent"); err == nil {
+		t.Error("Unexpected nil error reverting nonexistent repository")
+	}
+}
+
+func TestFdCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(dir+"/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := newFdCache(1)
+	fd1, done1, err := c.get(dir+"/a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, done2, err := c.get(dir+"/a", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fd1 != fd2 {
+		t.Error("Same version of a file should use the cached fd")
+	}
+	done2()
+
+	// Evicted while in use; the fd stays open until released
+	_, done3, err := c.get(dir+"/b", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done3()
+	if _, err := fd1.Stat(); err != nil {
+		t.Errorf("Fd in use should not be closed: %v", err)
+	}
+	done1()
+	if _, err := fd1.Stat(); err == nil {
+		t.Error("Evicted fd should be closed when released")
+	}
+
+	fd4, done4, err := c.get(dir+"/b", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done4()
+	c.forget(dir + "/b")
+	if _, err := fd4.Stat(); err == nil {
+		t.Error("Forgotten fd should be closed")
+	}
+
+	if _, _, err := c.get(dir+"/nonexistent", 1); err == nil {
+		t.Error("Unexpected nil error opening nonexistent file")
+	}
+}
+
+func TestRequestWindow(t *testing.T) {
+	opts := config.OptionsConfiguration{
+		ParallelRequests: 16,
+		MinRequestWindow: 4,
+		MaxRequestWindow: 128,
+	}
+	var tests = []struct {
+		rate   float64
+		rtt    time.Duration
+		window int
+	}{
+		{0, 0, 16},                                  // unknown
+		{10e6, 0, 16},                               // unknown latency
+		{100e6, time.Millisecond, 4},                // fast LAN
+		{1e6, 600 * time.Millisecond, 10},           // satellite
+		{10e6, 600 * time.Millisecond, 92},          // faster satellite
+		{100e6, 600 * time.Millisecond, 128},        // capped
+		{scanner.StandardBlockSize, time.Second, 4}, // slow
+	}
+	for i, tc := range tests {
+		if w := requestWindow(tc.rate, tc.rtt, opts); w != tc.window {
+			t.Errorf("%d: incorrect window %d != %d", i, w, tc.window)
+		}
+	}
+
+	tt := newThroughputTracker()
+	now := time.Now()
+	for i := 0; i <= 10; i++ {
+		tt.received(node1, scanner.StandardBlockSize, now.Add(time.Duration(i)*100*time.Millisecond))
+	}
+	if r := tt.rate(node1); r != 11*scanner.StandardBlockSize {
+		t.Errorf("Incorrect rate %f", r)
+	}
+
+	// An idle period does not count as slow
+	tt.received(node1, scanner.StandardBlockSize, now.Add(time.Minute))
+	tt.received(node1, scanner.StandardBlockSize, now.Add(time.Minute+time.Second))
+	if r := tt.rate(node1); r <= 2*scanner.StandardBlockSize {
+		t.Errorf("Idle time counted in rate %f", r)
+	}
+
+	tt.forget(node1)
+	if r := tt.rate(node1); r != 0 {
+		t.Errorf("Incorrect rate %f for forgotten node", r)
+	}
+}
+
+func TestScanSubs(t *testing.T) {
+	var tests = []struct {
+		paths []string
+		max   int
+		subs  []string
+	}{
+		{[]string{"a", "a/b", "a-c", "a/b/c"}, 10, []string{"a", "a-c"}},
+		{[]string{"a/b", "", "c"}, 10, []string{""}},
+		{[]string{"a/b/c", "a/b/d", "a/e"}, 10, []string{"a/b/c", "a/b/d", "a/e"}},
+		{[]string{"a/b/c", "a/b/d", "a/e"}, 2, []string{"a"}},
+		{[]string{"a/b", "c"}, 1, []string{""}},
+	}
+	for i, tc := range tests {
+		paths := make(map[string]bool)
+		for _, p := range tc.paths {
+			paths[p] = true
+		}
+		if subs := scanSubs(paths, tc.max); fmt.Sprint(subs) != fmt.Sprint(tc.subs) {
+			t.Errorf("%d: incorrect subs %q != %q", i, subs, tc.subs)
+		}
+	}
+}
+
+func TestHeldFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	m.AddRepo(config.RepositoryConfiguration{ID: "default", Directory: dir, StableTimeS: 60, InProgress: []string{"*.tmp"}})
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"stable", "growing", "log.tmp"} {
+		ioutil.WriteFile(dir+"/"+name, []byte(name), 0644)
+		if name != "growing" {
+			os.Chtimes(dir+"/"+name, old, old)
+		}
+	}
+	if err := m.ScanRepo("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	held := m.HeldFiles("default")
+	if len(held) != 2 || held[0].Name != "growing" || held[0].InProgress || held[1].Name != "log.tmp" || !held[1].InProgress {
+		t.Fatalf("Incorrect held files %v", held)
+	}
+	for _, name := range []string{"growing", "log.tmp"} {
+		if f := m.CurrentRepoFile("default", name); f.Name == name {
+			t.Errorf("Held file %q should not be announced", name)
+		}
+	}
+	if f := m.CurrentRepoFile("default", "stable"); f.Name != "stable" {
+		t.Error("Stable file should be announced")
+	}
+
+	os.Chtimes(dir+"/growing", old, old)
+	if err := m.ScanRepoSub("default", "growing"); err != nil {
+		t.Fatal(err)
+	}
+	if held := m.HeldFiles("default"); len(held) != 1 || held[0].Name != "log.tmp" {
+		t.Errorf("Incorrect held files %v after the file became stable", held)
+	}
+	if f := m.CurrentRepoFile("default", "growing"); f.Name != "growing" {
+		t.Error("File should be announced once stable")
+	}
+}
+
+func TestMoveConflict(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel("/tmp", &config.Configuration{}, node0, "node", "syncthing", "dev", db)
+	cfg := config.RepositoryConfiguration{ID: "default", Directory: dir}
+	m.AddRepo(cfg)
+	p := &puller{repoCfg: cfg, model: m}
+
+	local, remote := node0.Short(), node1.Short()
+	ours := protocol.Vector{}.Update(local)
+	m.updateLocal("default", protocol.FileInfo{Name: "file", Version: 10, Vector: ours})
+	ioutil.WriteFile(dir+"/file", []byte("ours"), 0644)
+
+	// The remote version includes our change, despite the lower lamport
+	// version, as after reconnecting to a node with a delta index
+	if p.moveConflict(protocol.FileInfo{Name: "file", Version: 5, Vector: ours.Update(remote)}, dir+"/file") {
+		t.Error("Dominating version should not cause a conflict copy")
+	}
+	if p.moveConflict(protocol.FileInfo{Name: "file", Version: 5, Vector: ours}, dir+"/file") {
+		t.Error("Same version should not cause a conflict copy")
+	}
+	if !p.moveConflict(protocol.FileInfo{Name: "file", Version: 11, Vector: protocol.Vector{}.Update(remote)}, dir+"/file") {
+		t.Error("Concurrent version should cause a conflict copy")
+	}
+	if _, err := os.Stat(dir + "/file"); !os.IsNotExist(err) {
+		t.Error("Our copy should have been moved away")
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"bufio"
+	"container/heap"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncthing/syncthing/config"
+	"github.com/syncthing/syncthing/ignore"
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// The priority file in the root of a repository lists patterns, one per
+// line and in the same syntax as .stignore, of files to pull before others.
+// Files matching an earlier line are pulled first; files not matching any
+// line are pulled last. Within each priority the repository's pull order is
+// used.
+const priorityFile = ".stpriority"
+
+// priorities holds the patterns of a priority file, highest priority first.
+type priorities []ignore.Patterns
+
+func loadPriorities(file string) (priorities, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var ps priorities
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		pats, err := ignore.Parse(strings.NewReader(line), file)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, pats)
+	}
+	return ps, sc.Err()
+}
+
+// priority returns the index of the first line matching the file, or the
+// number of lines if none does. Lower values are pulled first.
+func (ps priorities) priority(name string) int {
+	for i, pats := range ps {
+		if pats.Match(name) {
+			return i
+		}
+	}
+	return len(ps)
+}
+
+type neededFile struct {
+	protocol.FileInfoTruncated
+	priority int
+	seq      int64 // breaks ties between otherwise equal files
+}
+
+type neededFileList struct {
+	files []neededFile
+	less  func(a, b protocol.FileInfoTruncated) bool
+}
+
+func (l neededFileList) Len() int {
+	return len(l.files)
+}
+
+func (l neededFileList) Less(a, b int) bool {
+	return l.before(l.files[a], l.files[b])
+}
+
+func (l neededFileList) Swap(a, b int) {
+	l.files[a], l.files[b] = l.files[b], l.files[a]
+}
+
+// before returns true if a is to be pulled before b.
+func (l neededFileList) before(a, b neededFile) bool {
+	if a.priority != b.priority {
+		return a.priority < b.priority
+	}
+	if l.less != nil {
+		if l.less(a.FileInfoTruncated, b.FileInfoTruncated) {
+			return true
+		}
+		if l.less(b.FileInfoTruncated, a.FileInfoTruncated) {
+			return false
+		}
+	}
+	return a.seq < b.seq
+}
+
+// orderLess returns the comparison function for the given pull order, or
+// nil for random order.
+func orderLess(order string) func(a, b protocol.FileInfoTruncated) bool {
+	switch order {
+	case config.OrderRandom:
+		return nil
+	case config.OrderSmallestFirst:
+		return func(a, b protocol.FileInfoTruncated) bool {
+			return a.Size() < b.Size()
+		}
+	case config.OrderLargestFirst:
+		return func(a, b protocol.FileInfoTruncated) bool {
+			return a.Size() > b.Size()
+		}
+	case config.OrderOldestFirst:
+		return func(a, b protocol.FileInfoTruncated) bool {
+			return a.Modified < b.Modified
+		}
+	case config.OrderNewestFirst:
+		return func(a, b protocol.FileInfoTruncated) bool {
+			return a.Modified > b.Modified
+		}
+	}
+	return func(a, b protocol.FileInfoTruncated) bool {
+		return a.Name < b.Name
+	}
+}
+
+// A neededBatch keeps the first max of the files added to it, in pull
+// order, without holding on to the others. The files kept are a heap with
+// the one to pull last on top, so that it can be replaced by a file to pull
+// earlier.
+type neededBatch struct {
+	neededFileList
+	max   int
+	added int // including the files not kept
+	ps    priorities
+}
+
+func newNeededBatch(max int, order string, ps priorities) *neededBatch {
+	return &neededBatch{
+		neededFileList: neededFileList{less: orderLess(order)},
+		max:            max,
+		ps:             ps,
+	}
+}
+
+func (b *neededBatch) Less(a, c int) bool {
+	return b.before(b.files[c], b.files[a])
+}
+
+func (b *neededBatch) Push(x interface{}) {
+	b.files = append(b.files, x.(neededFile))
+}
+
+func (b *neededBatch) Pop() interface{} {
+	f := b.files[len(b.files)-1]
+	b.files = b.files[:len(b.files)-1]
+	return f
+}
+
+func (b *neededBatch) add(f protocol.FileInfoTruncated) {
+	nf := neededFile{
+		FileInfoTruncated: f,
+		priority:          b.ps.priority(f.Name),
+	}
+	if b.less == nil {
+		// Random order
+		nf.seq = rand.Int63()
+	} else {
+		// Files are added in name order, which is kept for files that are
+		// otherwise equal.
+		nf.seq = int64(b.added)
+	}
+	b.added++
+
+	if len(b.files) < b.max {
+		heap.Push(b, nf)
+	} else if b.max > 0 && b.before(nf, b.files[0]) {
+		b.files[0] = nf
+		heap.Fix(b, 0)
+	}
+}
+
+// sorted returns the files kept, in pull order.
+func (b *neededBatch) sorted() []protocol.FileInfoTruncated {
+	sort.Sort(b.neededFileList)
+	fs := make([]protocol.FileInfoTruncated, len(b.files))
+	for i := range b.files {
+		fs[i] = b.files[i].FileInfoTruncated
+	}
+	return fs
+}
+
+// neededFiles returns the next files to pull, in order, up to about
+// indexBatchSize files or pullIterationBlocks blocks. Files for which skip
+// returns true are left out. Deletions are returned only once all other
+// needed files fit in the batch, so that files are not deleted before the
+// files they were renamed to are seen, except for those of files renamed to
+// a file in the batch.
+func (p *puller) neededFiles(skip func(name string, version uint64) bool) []protocol.FileInfo {
+	p.model.rmut.RLock()
+	rf, ok := p.model.repoFiles[p.repoCfg.ID]
+	p.model.rmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	needed := newNeededBatch(indexBatchSize, p.repoCfg.Order, p.currentPriorities())
+	var deleted []protocol.FileInfoTruncated
+	rf.WithNeedTruncated(protocol.LocalNodeID, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfoTruncated)
+		switch {
+		case skip(f.Name, f.Version):
+		case f.IsDeleted():
+			if len(deleted) < indexBatchSize {
+				deleted = append(deleted, f)
+			}
+		default:
+			needed.add(f)
+		}
+		return true
+	})
+
+	files := make([]protocol.FileInfo, 0, indexBatchSize)
+	nblocks := 0
+	for _, f := range needed.sorted() {
+		if nblocks >= pullIterationBlocks {
+			break
+		}
+		gf := rf.GetGlobal(f.Name)
+		files = append(files, gf)
+		nblocks += len(gf.Blocks)
+	}
+	if needed.added == len(files) {
+		for _, f := range deleted {
+			files = append(files, rf.GetGlobal(f.Name))
+		}
+	}
+	return append(files, p.renameSources(rf, files, skip)...)
+}
+
+// currentPriorities returns the patterns of the repository's priority file.
+// The file is parsed again only when it has been modified.
+func (p *puller) currentPriorities() priorities {
+	file := filepath.Join(p.repoCfg.Directory, priorityFile)
+	info, err := os.Stat(file)
+	if err != nil {
+		p.priorities, p.priorityMod = nil, time.Time{}
+		return nil
+	}
+	if info.ModTime().Equal(p.priorityMod) {
+		return p.priorities
+	}
+
+	ps, err := loadPriorities(file)
+	if err != nil {
+		l.Infof(logPrefix, "%q: loading priorities: %v", p.repoCfg.ID, err)
+	}
+	p.priorities, p.priorityMod = ps, info.ModTime()
+	return ps
+}
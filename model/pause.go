@@ -0,0 +1,125 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"errors"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+var (
+	ErrRepoPaused = errors.New("repository is paused")
+	errNoSuchRepo = errors.New("no such repo")
+	errNoSuchNode = errors.New("no such node")
+)
+
+// PauseRepo stops scanning and pulling the repository until it is resumed.
+// Files already being pulled are completed. The paused state is saved in the
+// configuration.
+func (m *Model) PauseRepo(repo string) error {
+	if err := m.setRepoPaused(repo, true); err != nil {
+		return err
+	}
+	l.Infof(logPrefix, "Paused repository %q", repo)
+	m.setState(repo, RepoPaused)
+	return nil
+}
+
+// ResumeRepo resumes scanning and pulling the repository. It returns to the
+// state it was in when paused, such as out of space, until the puller finds
+// otherwise.
+func (m *Model) ResumeRepo(repo string) error {
+	if err := m.setRepoPaused(repo, false); err != nil {
+		return err
+	}
+	l.Infof(logPrefix, "Resumed repository %q", repo)
+	m.smut.RLock()
+	state := m.repoResumeState[repo]
+	m.smut.RUnlock()
+	m.setState(repo, state)
+	return nil
+}
+
+// RepoPaused returns true if the repository is paused.
+func (m *Model) RepoPaused(repo string) bool {
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	return m.repoPaused[repo]
+}
+
+func (m *Model) setRepoPaused(repo string, paused bool) error {
+	m.rmut.RLock()
+	_, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return errNoSuchRepo
+	}
+
+	m.smut.Lock()
+	if paused && !m.repoPaused[repo] {
+		m.repoResumeState[repo] = m.repoState[repo]
+	}
+	m.repoPaused[repo] = paused
+	m.smut.Unlock()
+
+	for i := range m.cfg.Repositories {
+		if m.cfg.Repositories[i].ID == repo {
+			m.cfg.Repositories[i].Paused = paused
+		}
+	}
+	return m.cfg.Save()
+}
+
+// PauseNode closes the connection to the node and refuses new connections
+// from it until it is resumed. The paused state is saved in the
+// configuration.
+func (m *Model) PauseNode(node protocol.NodeID) error {
+	if err := m.setNodePaused(node, true); err != nil {
+		return err
+	}
+	l.Infof(logPrefix, "Paused node %s", node)
+
+	m.pmut.RLock()
+	conn, ok := m.rawConn[node]
+	m.pmut.RUnlock()
+	if ok {
+		// Closing the connection makes the protocol layer call Close,
+		// which cleans up after the node.
+		conn.Close()
+	}
+	return nil
+}
+
+// ResumeNode allows connections to and from the node again.
+func (m *Model) ResumeNode(node protocol.NodeID) error {
+	if err := m.setNodePaused(node, false); err != nil {
+		return err
+	}
+	l.Infof(logPrefix, "Resumed node %s", node)
+	return nil
+}
+
+// NodePaused returns true if connections to and from the node should not be
+// made.
+func (m *Model) NodePaused(node protocol.NodeID) bool {
+	m.smut.RLock()
+	defer m.smut.RUnlock()
+	return m.nodePaused[node]
+}
+
+func (m *Model) setNodePaused(node protocol.NodeID, paused bool) error {
+	nodeCfg := m.cfg.GetNodeConfiguration(node)
+	if nodeCfg == nil || node == m.myID {
+		return errNoSuchNode
+	}
+
+	m.smut.Lock()
+	m.nodePaused[node] = paused
+	m.smut.Unlock()
+
+	nodeCfg.Paused = paused
+	return m.cfg.Save()
+}
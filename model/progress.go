@@ -0,0 +1,158 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// How often changes to the set of files being downloaded are sent to peers.
+const downloadProgressInterval = 5 * time.Second
+
+// A download is a file being pulled, by us or by a peer, and the blocks of
+// it that are already in the temporary file.
+type download struct {
+	version uint64
+	temp    string // temporary file name; only known for our own downloads
+	have    map[uint32]struct{}
+}
+
+func newDownload(version uint64, temp string, blocks []uint32) *download {
+	d := &download{
+		version: version,
+		temp:    temp,
+		have:    make(map[uint32]struct{}, len(blocks)),
+	}
+	for _, b := range blocks {
+		d.have[b] = struct{}{}
+	}
+	return d
+}
+
+func (d *download) hasBlock(index uint32) bool {
+	_, ok := d.have[index]
+	return ok
+}
+
+func (d *download) blocks() []uint32 {
+	bs := make([]uint32, 0, len(d.have))
+	for b := range d.have {
+		bs = append(bs, b)
+	}
+	sort.Sort(uint32Slice(bs))
+	return bs
+}
+
+// downloadTracker keeps track of the files the pullers are downloading, so
+// that other nodes can be told about them and be served blocks from the
+// temporary files.
+type downloadTracker struct {
+	repos   map[string]map[string]*download // repo -> name -> download
+	changed map[string]bool                 // repos changed since the last call to changes
+	mut     sync.RWMutex
+}
+
+func newDownloadTracker() *downloadTracker {
+	return &downloadTracker{
+		repos:   make(map[string]map[string]*download),
+		changed: make(map[string]bool),
+	}
+}
+
+// started records that we have begun downloading the given version of the
+// file into the temporary file, which already holds the given blocks.
+func (t *downloadTracker) started(repo, name string, version uint64, temp string, blocks []uint32) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	files, ok := t.repos[repo]
+	if !ok {
+		files = make(map[string]*download)
+		t.repos[repo] = files
+	}
+	files[name] = newDownload(version, temp, blocks)
+	t.changed[repo] = true
+}
+
+// gotBlock records that the block with the given index has been written to
+// the temporary file.
+func (t *downloadTracker) gotBlock(repo, name string, index uint32) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if d, ok := t.repos[repo][name]; ok {
+		d.have[index] = struct{}{}
+		t.changed[repo] = true
+	}
+}
+
+// finished records that the file is no longer being downloaded, whether it
+// completed or failed.
+func (t *downloadTracker) finished(repo, name string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if _, ok := t.repos[repo][name]; ok {
+		delete(t.repos[repo], name)
+		t.changed[repo] = true
+	}
+}
+
+// temporary returns the name of the temporary file holding the block with
+// the given index of the file, if we have that block.
+func (t *downloadTracker) temporary(repo, name string, index uint32) (string, bool) {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	d, ok := t.repos[repo][name]
+	if !ok || !d.hasBlock(index) {
+		return "", false
+	}
+	return d.temp, true
+}
+
+// progress returns the files being downloaded in the repository.
+func (t *downloadTracker) progress(repo string) []protocol.FileDownloadProgress {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+
+	return t.progressLocked(repo)
+}
+
+func (t *downloadTracker) progressLocked(repo string) []protocol.FileDownloadProgress {
+	var files []protocol.FileDownloadProgress
+	for name, d := range t.repos[repo] {
+		files = append(files, protocol.FileDownloadProgress{
+			Name:    name,
+			Version: d.version,
+			Blocks:  d.blocks(),
+		})
+	}
+	return files
+}
+
+// changes returns the files being downloaded in each repository that has
+// changed since the previous call.
+func (t *downloadTracker) changes() map[string][]protocol.FileDownloadProgress {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	res := make(map[string][]protocol.FileDownloadProgress, len(t.changed))
+	for repo := range t.changed {
+		res[repo] = t.progressLocked(repo)
+	}
+	t.changed = make(map[string]bool)
+	return res
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Less(a, b int) bool { return s[a] < s[b] }
+func (s uint32Slice) Swap(a, b int)      { s[a], s[b] = s[b], s[a] }
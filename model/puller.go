@@ -25,9 +25,10 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"errors"
 	"fmt"
-	"math/rand"
+	"math"
 	"os"
 	"path/filepath"
 	"time"
@@ -45,18 +46,24 @@ type requestResult struct {
 	file     protocol.FileInfo
 	filepath string // full filepath name
 	offset   int64
+	size     int
 	data     []byte
 	err      error
+	flags    uint32            // request flags; protocol.FlagRequestTemporary if asked from a download in progress
+	tried    []protocol.NodeID // nodes that timed out on this block before
 }
 
 type openFile struct {
 	filepath     string // full filepath name
 	temp         string // temporary filename
 	availability []protocol.NodeID
+	record       *os.File      // record of the blocks in the temporary file
+	verifier     *tempVerifier // looking for blocks left in the temporary file
 	file         *os.File
 	err          error // error when opening or writing to file, all following operations are cancelled
 	outstanding  int   // number of requests we still have outstanding
 	done         bool  // we have sent all requests for this file
+	grow         int64 // how much the repository grows when the file is done
 }
 
 type activityMap map[protocol.NodeID]int
@@ -66,13 +73,58 @@ type activityMap map[protocol.NodeID]int
 // consumption. 1000 blocks ~= 1000 * 128 KiB ~= 125 MiB of data.
 const pullIterationBlocks = 1000
 
-func (m activityMap) leastBusyNode(availability []protocol.NodeID, isValid func(protocol.NodeID) bool) protocol.NodeID {
-	var low int = 2<<30 - 1
-	var selected protocol.NodeID
+// Temporary files are kept this long after they were last written to, so
+// that downloads interrupted by a disconnect or restart can be resumed.
+const tempLifetime = 24 * time.Hour
+
+// Give up on a block request after this long and ask another node instead.
+// A block is at most 128 KiB so this is generous even for slow links.
+const blockRequestTimeout = 60 * time.Second
+
+// leastBusyNode returns the valid node with the fewest outstanding requests
+// and counts a new request against it. If latency is not nil, the
+// outstanding requests are weighted by the latency of each node, so that
+// nodes that respond faster get more of the requests. Nodes with unknown
+// latency are assumed to be average.
+func (m activityMap) leastBusyNode(availability []protocol.NodeID, isValid func(protocol.NodeID) bool, latency func(protocol.NodeID) time.Duration) protocol.NodeID {
+	var valid []protocol.NodeID
 	for _, node := range availability {
-		usage := m[node]
-		if usage < low && isValid(node) {
-			low = usage
+		if isValid(node) {
+			valid = append(valid, node)
+		}
+	}
+
+	weights := make([]float64, len(valid))
+	for i := range weights {
+		weights[i] = 1
+	}
+	if latency != nil {
+		var sum time.Duration
+		var known int
+		lats := make([]time.Duration, len(valid))
+		for i, node := range valid {
+			lats[i] = latency(node)
+			if lats[i] > 0 {
+				sum += lats[i]
+				known++
+			}
+		}
+		if known > 0 {
+			avg := sum / time.Duration(known)
+			for i, lat := range lats {
+				if lat == 0 {
+					lat = avg
+				}
+				weights[i] = float64(lat)
+			}
+		}
+	}
+
+	var low = math.MaxFloat64
+	var selected protocol.NodeID
+	for i, node := range valid {
+		if cost := float64(m[node]+1) * weights[i]; cost < low {
+			low = cost
 			selected = node
 		}
 	}
@@ -84,7 +136,10 @@ func (m activityMap) decrease(node protocol.NodeID) {
 	m[node]--
 }
 
-var errNoNode = errors.New("no available source node")
+var (
+	errNoNode       = errors.New("no available source node")
+	errHashMismatch = errors.New("block hash mismatch")
+)
 
 type puller struct {
 	cfg               *config.Configuration
@@ -99,6 +154,13 @@ type puller struct {
 	requestResults    chan requestResult
 	versioner         versioner.Versioner
 	errors            int
+	gone              map[string]uint64 // version of files that no connected node could serve
+	localBytes        int64             // size of the repository, including the files being pulled
+	spaceErr          error             // why pulling is paused for lack of space, if it is
+	spaceFile         protocol.FileInfo // the file that did not fit
+	busy              bool              // the request windows of all sources of a block are full
+	priorities        priorities        // parsed from the priority file
+	priorityMod       time.Time         // modification time of the parsed priority file
 }
 
 func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int, cfg *config.Configuration) *puller {
@@ -112,6 +174,7 @@ func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int,
 		requestSlots:      make(chan bool, slots),
 		blocks:            make(chan bqBlock),
 		requestResults:    make(chan requestResult),
+		gone:              make(map[string]uint64),
 	}
 
 	if len(repoCfg.Versioning.Type) > 0 {
@@ -140,10 +203,11 @@ func newPuller(repoCfg config.RepositoryConfiguration, model *Model, slots int,
 
 func (p *puller) run() {
 	changed := true
-	scanintv := time.Duration(p.repoCfg.RescanIntervalS) * time.Second
+	scanintv := p.rescanInterval()
 	lastscan := time.Now()
 	var prevVer uint64
 	var queued int
+	var paused bool
 
 	// Load up the request slots
 	for i := 0; i < cap(p.requestSlots); i++ {
@@ -155,6 +219,24 @@ func (p *puller) run() {
 			panic(fmt.Sprintf("Incorrect number of slots; %d != %d", sl, sc))
 		}
 
+		if p.model.RepoPaused(p.repoCfg.ID) {
+			paused = true
+			p.model.setState(p.repoCfg.ID, RepoPaused)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if paused {
+			// Files were skipped while paused
+			paused = false
+			prevVer = 0
+		}
+
+		if p.spaceErr != nil && p.spaceAvailable() {
+			l.Infof(logPrefix, "Resuming pulling in repo %q; there is space available", p.repoCfg.ID)
+			p.spaceErr = nil
+			prevVer = 0 // look at all needed files again
+		}
+
 		// Run the pulling loop as long as there are blocks to fetch
 		prevVer, queued = p.queueNeededBlocks(prevVer)
 		if queued > 0 {
@@ -162,14 +244,24 @@ func (p *puller) run() {
 
 		pull:
 			for {
+				// When every node that could serve the next block already
+				// has its window of requests outstanding, wait for one of
+				// them to complete before trying again.
+				slots := p.requestSlots
+				if p.busy {
+					slots = nil
+				}
+
 				select {
 				case res := <-p.requestResults:
+					p.busy = false
 					p.model.setState(p.repoCfg.ID, RepoSyncing)
 					changed = true
-					p.requestSlots <- true
 					p.handleRequestResult(res)
+					// Request was fully handled, free up the slot
+					p.requestSlots <- true
 
-				case <-p.requestSlots:
+				case <-slots:
 					b, ok := p.bq.get()
 
 					if !ok {
@@ -219,9 +311,7 @@ func (p *puller) run() {
 			}
 
 			if p.errors > 0 && p.errors >= queued {
-				l.Warnf("All remaining files failed to sync. Stopping repo %q.", p.repoCfg.ID)
-				invalidateRepo(p.cfg, p.repoCfg.ID, errors.New("too many errors, check logs"))
-				return
+				l.Infof(logPrefix, "%q: all remaining files failed to sync; they will be retried later", p.repoCfg.ID)
 			}
 		}
 
@@ -231,7 +321,11 @@ func (p *puller) run() {
 			changed = false
 		}
 
-		p.model.setState(p.repoCfg.ID, RepoIdle)
+		if p.spaceErr != nil {
+			p.model.setState(p.repoCfg.ID, RepoOutOfSpace)
+		} else {
+			p.model.setState(p.repoCfg.ID, RepoIdle)
+		}
 
 		// Do a rescan if it's time for it
 		if time.Since(lastscan) > scanintv {
@@ -240,7 +334,7 @@ func (p *puller) run() {
 			}
 
 			err := p.model.ScanRepo(p.repoCfg.ID)
-			if err != nil {
+			if err != nil && err != ErrRepoPaused {
 				invalidateRepo(p.cfg, p.repoCfg.ID, err)
 				return
 			}
@@ -252,20 +346,37 @@ func (p *puller) run() {
 }
 
 func (p *puller) runRO() {
-	walkTicker := time.Tick(time.Duration(p.repoCfg.RescanIntervalS) * time.Second)
+	walkTicker := time.Tick(p.rescanInterval())
 
 	for _ = range walkTicker {
 		if debug {
 			l.Debugf(logPrefix, "%q: time for rescan", p.repoCfg.ID)
 		}
 		err := p.model.ScanRepo(p.repoCfg.ID)
-		if err != nil {
+		if err != nil && err != ErrRepoPaused {
 			invalidateRepo(p.cfg, p.repoCfg.ID, err)
 			return
 		}
 	}
 }
 
+// rescanInterval starts watching the repository for changes if so
+// configured, and returns how often the whole repository is scanned.
+func (p *puller) rescanInterval() time.Duration {
+	intv := time.Duration(p.repoCfg.RescanIntervalS) * time.Second
+	if !p.repoCfg.Watch {
+		return intv
+	}
+	if err := p.model.WatchRepo(p.repoCfg.ID); err != nil {
+		l.Warnf("Cannot watch repository %q for changes: %v; scanning every %v", p.repoCfg.ID, err, intv)
+		return intv
+	}
+	if intv < watchRescanInterval {
+		intv = watchRescanInterval
+	}
+	return intv
+}
+
 // clean deletes orphaned temporary files and directories that should no
 // longer exist.
 func (p *puller) clean() {
@@ -277,7 +388,7 @@ func (p *puller) clean() {
 			return err
 		}
 
-		if info.Mode().IsRegular() && defTempNamer.IsTemporary(path) {
+		if info.Mode().IsRegular() && defTempNamer.IsTemporary(path) && time.Since(info.ModTime()) >= tempLifetime {
 			os.Remove(path)
 		}
 
@@ -365,6 +476,9 @@ func (p *puller) clean() {
 	}
 }
 
+// handleRequestResult writes the fetched block to the temporary file, or
+// queues the block to be requested from another node if it timed out or the
+// node no longer has the file.
 func (p *puller) handleRequestResult(res requestResult) {
 	p.oustandingPerNode.decrease(res.node)
 	f := res.file
@@ -375,6 +489,43 @@ func (p *puller) handleRequestResult(res requestResult) {
 		return
 	}
 
+	temp := res.flags&protocol.FlagRequestTemporary != 0
+	if temp && res.err == nil && !blockHashOK(f, res.offset, res.data) {
+		// Data from a download in progress is not verified by the sender
+		res.err = errHashMismatch
+	}
+
+	retry := temp && res.err != nil || res.err == protocol.ErrTimeout || res.err == protocol.ErrNoSuchFile || res.err == protocol.ErrInvalid
+	if retry && of.err == nil {
+		// The node is slow, stuck, has changed the file since it sent us
+		// its index or no longer has the block of its own download. Try
+		// someone that has the complete file before failing the file.
+		tried := append(res.tried, res.node)
+		for _, node := range of.availability {
+			if !nodeTried(node, tried) && p.model.ConnectedTo(node) {
+				l.Infof(logPrefix, "pull: %q / %q offset %d: request to %s failed (%v), retrying", p.repoCfg.ID, f.Name, res.offset, res.node, res.err)
+				// The block is requested again from the queue, once a
+				// node has room in its request window.
+				p.bq.unget(bqBlock{
+					file:  f,
+					block: f.Blocks[blockIndex(res.offset)],
+					last:  of.done,
+					tried: tried,
+				})
+				of.done = false
+				of.outstanding--
+				p.openFiles[f.Name] = of
+				return
+			}
+		}
+	}
+
+	if !temp && (res.err == protocol.ErrNoSuchFile || res.err == protocol.ErrInvalid) {
+		// Nobody we asked has this version of the file any more. Don't
+		// retry it until we see a new version in an index update.
+		p.gone[f.Name] = f.Version
+	}
+
 	if res.err != nil {
 		// This request resulted in an error
 		of.err = res.err
@@ -384,6 +535,9 @@ func (p *puller) handleRequestResult(res requestResult) {
 	} else if of.err == nil {
 		// This request was sucessfull and nothing has failed previously either
 		_, of.err = of.file.WriteAt(res.data, res.offset)
+		if of.err == nil {
+			p.gotBlock(f.Name, of, blockIndex(res.offset))
+		}
 		if debug {
 			l.Debugf("pull: wrote %q / %q offset %d len %d outstanding %d done %v", p.repoCfg.ID, f.Name, res.offset, len(res.data), of.outstanding, of.done)
 		}
@@ -415,8 +569,9 @@ func (p *puller) handleBlock(b bqBlock) bool {
 				}
 				err = os.MkdirAll(path, os.FileMode(f.Flags&0777))
 				if err != nil {
-					p.errors++
+					p.fail(f, err)
 					l.Infof(logPrefix, "mkdir: error: %q: %v", path, err)
+					return true
 				}
 			}
 		} else if debug {
@@ -457,6 +612,27 @@ func (p *puller) handleBlock(b bqBlock) bool {
 	of, ok := p.openFiles[f.Name]
 	of.done = b.last
 
+	if !ok && p.model.RepoPaused(p.repoCfg.ID) {
+		// Files already being pulled are completed, others wait until
+		// the repository is resumed.
+		return true
+	}
+
+	if !ok && !protocol.IsDeleted(f.Flags) {
+		if p.spaceErr != nil {
+			// Pulling is paused until there is space; deletions still go
+			// ahead as they may free some.
+			return true
+		}
+		cur := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+		of.grow = f.Size() - cur.Size()
+		if err := p.checkSpace(f.Size(), of.grow); err != nil {
+			p.outOfSpace(f, err)
+			return true
+		}
+		p.localBytes += of.grow
+	}
+
 	if !ok {
 		if debug {
 			l.Debugf("pull: %q: opening file %q", p.repoCfg.ID, f.Name)
@@ -490,9 +666,17 @@ func (p *puller) handleBlock(b bqBlock) bool {
 			defer os.Chmod(dirName, info.Mode())
 		}
 
-		of.file, of.err = os.Create(of.temp)
+		// A temporary file left by an interrupted download of the file is
+		// reused; the blocks in it that are still correct need not be
+		// fetched again.
+		_, err = os.Stat(of.temp)
+		resuming := err == nil
+		of.file, of.err = os.OpenFile(of.temp, os.O_RDWR|os.O_CREATE, 0666)
+		if of.err == nil {
+			of.err = of.file.Truncate(f.Size())
+		}
 		if of.err != nil {
-			p.errors++
+			p.fail(f, of.err)
 			l.Infof(logPrefix, "create: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
 			if !b.last {
 				p.openFiles[f.Name] = of
@@ -500,6 +684,30 @@ func (p *puller) handleBlock(b bqBlock) bool {
 			return true
 		}
 		osutil.HideFile(of.temp)
+
+		var resumed []uint32
+		var recorded bool
+		if !protocol.IsDeleted(f.Flags) {
+			record := blockRecordName(of.filepath)
+			of.record, resumed, recorded, err = openBlockRecord(record, f.Version, resuming)
+			if err != nil {
+				l.Infof(logPrefix, "create: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+			} else {
+				osutil.HideFile(record)
+			}
+			if debug && resuming {
+				l.Debugf(logPrefix, "pull: %q / %q: resuming with %d of %d blocks recorded", p.repoCfg.ID, f.Name, len(resumed), len(f.Blocks))
+			}
+		}
+		p.model.downloads.started(p.repoCfg.ID, f.Name, f.Version, of.temp, resumed)
+		if resuming && !recorded && !protocol.IsDeleted(f.Flags) {
+			// Hashing a large file would hold up the puller, so the blocks
+			// found are skipped as they turn up.
+			name, rof := f.Name, of
+			of.verifier = verifyTemp(of.temp, f.Blocks, func(index uint32) {
+				p.gotBlock(name, rof, index)
+			})
+		}
 	}
 
 	if of.err != nil {
@@ -508,7 +716,7 @@ func (p *puller) handleBlock(b bqBlock) bool {
 			l.Debugf("pull: error: %q / %q has already failed: %v", p.repoCfg.ID, f.Name, of.err)
 		}
 		if b.last {
-			delete(p.openFiles, f.Name)
+			p.forgetFile(f.Name)
 		}
 
 		return true
@@ -542,7 +750,7 @@ func (p *puller) handleCopyBlock(b bqBlock) {
 	var exfd *os.File
 	exfd, of.err = os.Open(of.filepath)
 	if of.err != nil {
-		p.errors++
+		p.fail(f, of.err)
 		l.Infof(logPrefix, "open: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
 		of.file.Close()
 		of.file = nil
@@ -558,8 +766,11 @@ func (p *puller) handleCopyBlock(b bqBlock) {
 		if of.err == nil {
 			_, of.err = of.file.WriteAt(bs, b.Offset)
 		}
+		if of.err == nil {
+			p.gotBlock(f.Name, of, blockIndex(b.Offset))
+		}
 		if of.err != nil {
-			p.errors++
+			p.fail(f, of.err)
 			l.Infof(logPrefix, "write: error: %q / %q: %v", p.repoCfg.ID, f.Name, of.err)
 			exfd.Close()
 			of.file.Close()
@@ -581,13 +792,43 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 		panic("bug: request for non-open file")
 	}
 
-	node := p.oustandingPerNode.leastBusyNode(of.availability, p.model.ConnectedTo)
+	if _, ok := p.model.downloads.temporary(p.repoCfg.ID, f.Name, blockIndex(b.block.Offset)); ok || p.copyLocalBlock(f, of, b.block) {
+		if b.last && of.outstanding == 0 {
+			p.closeFile(f)
+		}
+		return true
+	}
+
+	// Nodes downloading the same file may have the block too, sparing the
+	// nodes that have the complete file. A block that failed before is
+	// requested from an untried node that has the complete file.
+	var sources []protocol.NodeID
+	for _, n := range of.availability {
+		if !nodeTried(n, b.tried) {
+			sources = append(sources, n)
+		}
+	}
+	if len(b.tried) == 0 {
+		sources = append(sources, p.model.downloadSources(p.repoCfg.ID, f, blockIndex(b.block.Offset))...)
+	}
+	node := p.oustandingPerNode.leastBusyNode(sources, p.hasRoom, p.model.nodeLatency)
 	if node == (protocol.NodeID{}) {
+		for _, n := range sources {
+			if p.model.ConnectedTo(n) {
+				// The block is requested once a window has room
+				of.done = false
+				p.openFiles[f.Name] = of
+				p.bq.unget(b)
+				p.busy = true
+				return true
+			}
+		}
+
 		of.err = errNoNode
 		if of.file != nil {
+			// The temporary file is kept for when a source appears
 			of.file.Close()
 			of.file = nil
-			os.Remove(of.temp)
 			if debug {
 				l.Debugf("pull: no source for %q / %q; closed", p.repoCfg.ID, f.Name)
 			}
@@ -596,7 +837,7 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 			if debug {
 				l.Debugf("pull: no source for %q / %q; deleting", p.repoCfg.ID, f.Name)
 			}
-			delete(p.openFiles, f.Name)
+			p.forgetFile(f.Name)
 		} else {
 			if debug {
 				l.Debugf("pull: no source for %q / %q; await more blocks", p.repoCfg.ID, f.Name)
@@ -606,31 +847,101 @@ func (p *puller) handleRequestBlock(b bqBlock) bool {
 		return true
 	}
 
+	var flags uint32 = protocol.FlagRequestTemporary
+	for _, n := range of.availability {
+		if n == node {
+			flags = 0
+			break
+		}
+	}
+
 	of.outstanding++
 	p.openFiles[f.Name] = of
 
-	go func(node protocol.NodeID, b bqBlock) {
+	if debug {
+		l.Debugf("pull: requesting %q / %q offset %d size %d from %q flags %x outstanding %d", p.repoCfg.ID, f.Name, b.block.Offset, b.block.Size, node, flags, of.outstanding)
+	}
+	p.requestBlock(node, f, of.filepath, b.block.Offset, int(b.block.Size), flags, b.tried)
+
+	return false
+}
+
+func nodeTried(node protocol.NodeID, tried []protocol.NodeID) bool {
+	for _, t := range tried {
+		if t == node {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRoom returns true if the node is connected and we have fewer requests
+// outstanding to it than its request window.
+func (p *puller) hasRoom(node protocol.NodeID) bool {
+	return p.model.ConnectedTo(node) && p.oustandingPerNode[node] < p.model.requestWindow(node)
+}
+
+// copyLocalBlock looks for the block in the local files of all repositories
+// and writes it to the temporary file if a copy with the right contents is
+// found. Returns true if the block was copied.
+func (p *puller) copyLocalBlock(f protocol.FileInfo, of openFile, b protocol.BlockInfo) bool {
+	buf := make([]byte, b.Size)
+	return p.model.finder.Iterate(b.Hash, func(repo, name string, offset int64) bool {
+		dir, ok := p.model.repoDir(repo)
+		if !ok {
+			return false
+		}
+		fd, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return false
+		}
+		_, err = fd.ReadAt(buf, offset)
+		fd.Close()
+		if err != nil {
+			return false
+		}
+
+		// The file may have changed since it was scanned
+		hash := sha256.Sum256(buf)
+		if !bytes.Equal(hash[:], b.Hash) {
+			return false
+		}
+
+		if _, err := of.file.WriteAt(buf, b.Offset); err != nil {
+			return false
+		}
+		p.gotBlock(f.Name, of, blockIndex(b.Offset))
 		if debug {
-			l.Debugf("pull: requesting %q / %q offset %d size %d from %q outstanding %d", p.repoCfg.ID, f.Name, b.block.Offset, b.block.Size, node, of.outstanding)
+			l.Debugf(logPrefix, "pull: copied %q / %q offset %d from local %q / %q offset %d", p.repoCfg.ID, f.Name, b.Offset, repo, name, offset)
 		}
+		return true
+	})
+}
 
-		bs, err := p.model.requestGlobal(node, p.repoCfg.ID, f.Name, b.block.Offset, int(b.block.Size), nil)
+// requestBlock fetches a block from the given node in the background and
+// delivers the outcome on p.requestResults.
+func (p *puller) requestBlock(node protocol.NodeID, f protocol.FileInfo, fp string, offset int64, size int, flags uint32, tried []protocol.NodeID) {
+	go func() {
+		bs, err := p.model.requestGlobal(node, p.repoCfg.ID, f.Name, offset, size, nil, flags, blockRequestTimeout)
 		p.requestResults <- requestResult{
 			node:     node,
 			file:     f,
-			filepath: of.filepath,
-			offset:   b.block.Offset,
+			filepath: fp,
+			offset:   offset,
+			size:     size,
 			data:     bs,
 			err:      err,
+			flags:    flags,
+			tried:    tried,
 		}
-	}(node, b)
-
-	return false
+	}()
 }
 
 func (p *puller) handleEmptyBlock(b bqBlock) {
 	f := b.file
 	of := p.openFiles[f.Name]
+	p.forgetFile(f.Name)
+	p.model.fds.forget(of.filepath)
 
 	if b.last {
 		if of.err == nil {
@@ -643,6 +954,7 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 			l.Debugf("pull: delete %q", f.Name)
 		}
 		os.Remove(of.temp)
+		os.Remove(blockRecordName(of.filepath))
 
 		// Ensure the file and the directory it is in is writeable so we can remove the file
 		dirName := filepath.Dir(of.filepath)
@@ -662,7 +974,9 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 			// Change it back after deleting the file, to minimize the time window with incorrect permissions
 			defer os.Chmod(dirName, info.Mode())
 		}
-		if p.versioner != nil {
+		if p.moveConflict(f, of.filepath) {
+			p.model.updateLocal(p.repoCfg.ID, f)
+		} else if p.versioner != nil {
 			if debug {
 				l.Debugln("pull: deleting with versioner")
 			}
@@ -680,24 +994,24 @@ func (p *puller) handleEmptyBlock(b bqBlock) {
 		}
 		t := time.Unix(f.Modified, 0)
 		if os.Chtimes(of.temp, t, t) != nil {
-			delete(p.openFiles, f.Name)
 			return
 		}
 		if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(f.Flags) && os.Chmod(of.temp, os.FileMode(f.Flags&0777)) != nil {
-			delete(p.openFiles, f.Name)
 			return
 		}
 		osutil.ShowFile(of.temp)
+		p.moveConflict(f, of.filepath)
 		if osutil.Rename(of.temp, of.filepath) == nil {
+			os.Remove(blockRecordName(of.filepath))
 			p.model.updateLocal(p.repoCfg.ID, f)
 		}
 	}
-	delete(p.openFiles, f.Name)
 }
 
 func (p *puller) queueNeededBlocks(prevVer uint64) (uint64, int) {
 	curVer := p.model.LocalVersion(p.repoCfg.ID)
-	if curVer == prevVer {
+	now := time.Now()
+	if curVer == prevVer && !p.model.failures.due(p.repoCfg.ID, now) {
 		return curVer, 0
 	}
 
@@ -705,23 +1019,51 @@ func (p *puller) queueNeededBlocks(prevVer uint64) (uint64, int) {
 		l.Debugf("%q: checking for more needed blocks", p.repoCfg.ID)
 	}
 
-	queued := 0
-	files := make([]protocol.FileInfo, 0, indexBatchSize)
-	for _, f := range p.model.NeedFilesRepoLimited(p.repoCfg.ID, indexBatchSize, pullIterationBlocks) {
-		if _, ok := p.openFiles[f.Name]; ok {
-			continue
+	if p.repoCfg.MaxSizeMiB > 0 {
+		_, _, p.localBytes = p.model.LocalSize(p.repoCfg.ID)
+		for _, of := range p.openFiles {
+			p.localBytes += of.grow
 		}
-		files = append(files, f)
 	}
 
-	perm := rand.Perm(len(files))
-	for _, idx := range perm {
-		f := files[idx]
+	queued := 0
+	unavailable := 0
+	files := p.neededFiles(func(name string, version uint64) bool {
+		if _, ok := p.openFiles[name]; ok {
+			return true
+		}
+		if v, ok := p.gone[name]; ok {
+			if v == version {
+				return true
+			}
+			delete(p.gone, name)
+		}
+		if p.repoCfg.ReceiveOnly && p.model.localChange(p.repoCfg.ID, name) {
+			// Left alone until the change is reverted
+			return true
+		}
+		return !p.model.failures.retry(p.repoCfg.ID, name, version, now)
+	})
+
+	// Renamed files are moved locally rather than deleted and pulled again.
+	files = p.handleRenames(files)
+
+	for _, f := range files {
 		lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
 		have, need := scanner.BlockDiff(lf.Blocks, f.Blocks)
 		if debug {
 			l.Debugf(logPrefix, "need:\n  local: %v\n  global: %v\n  haveBlocks: %v\n  needBlocks: %v", lf, f, have, need)
 		}
+		if len(need) > 0 && !p.sourceConnected(f.Name) {
+			// Indexes are kept for disconnected nodes, so the only nodes
+			// that have the file may currently be unreachable. Try again
+			// later.
+			if debug {
+				l.Debugf(logPrefix, "%q: no connected source for %q", p.repoCfg.ID, f.Name)
+			}
+			unavailable++
+			continue
+		}
 		queued++
 		p.bq.put(bqAdd{
 			file: f,
@@ -734,31 +1076,190 @@ func (p *puller) queueNeededBlocks(prevVer uint64) (uint64, int) {
 		l.Debugf(logPrefix, "%q: queued %d items", p.repoCfg.ID, queued)
 	}
 
-	if queued > 0 {
+	if queued > 0 || unavailable > 0 {
 		return prevVer, queued
 	} else {
 		return curVer, 0
 	}
 }
 
+// sourceConnected returns true if at least one node that has the current
+// version of the file is connected.
+func (p *puller) sourceConnected(name string) bool {
+	p.model.rmut.RLock()
+	availability := p.model.repoFiles[p.repoCfg.ID].Availability(name)
+	p.model.rmut.RUnlock()
+
+	for _, node := range availability {
+		if p.model.ConnectedTo(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// moveConflict renames our copy of the file to a conflict name if it has
+// changes that no other node has seen, as replacing or deleting it with f
+// would lose them. Returns true if the file was moved.
+func (p *puller) moveConflict(f protocol.FileInfo, path string) bool {
+	if p.repoCfg.ReceiveOnly {
+		// Local changes are reverted, not kept
+		return false
+	}
+	cur := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+	if cur.Name != f.Name || protocol.IsDeleted(cur.Flags) || protocol.IsDirectory(cur.Flags) {
+		return false
+	}
+	if cur.Vector.IsEmpty() || f.Vector.IsEmpty() {
+		// Changed by a node that predates version vectors. Our copy
+		// conflicts if it is a different version with changes that no
+		// other node has seen.
+		if cur.Version == f.Version || !p.model.locallyChanged(p.repoCfg.ID, f.Name) {
+			return false
+		}
+	} else if cur.Vector.Compare(f.Vector) != protocol.Concurrent {
+		// Either f includes our changes, or we have f already
+		return false
+	}
+	if _, err := os.Lstat(path); err != nil {
+		return false
+	}
+
+	cname := conflictName(f.Name, time.Now(), p.model.myID)
+	err := osutil.Rename(path, filepath.Join(p.repoCfg.Directory, cname))
+	if err != nil {
+		l.Infof(logPrefix, "conflict: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		return false
+	}
+
+	l.Infof(logPrefix, "Conflicting changes to %q / %q; our copy was kept as %q", p.repoCfg.ID, f.Name, cname)
+	events.Default.Log(events.ConflictCreated, map[string]string{
+		"repo":     p.repoCfg.ID,
+		"item":     f.Name,
+		"conflict": cname,
+	})
+	return true
+}
+
+// checkSpace returns an error if pulling a file of the given size, which
+// grows the repository by grow bytes, would leave less free disk space than
+// configured or make the repository larger than its maximum size.
+func (p *puller) checkSpace(size, grow int64) error {
+	if min := int64(p.repoCfg.MinDiskFreeMiB) << 20; min > 0 {
+		free, err := osutil.DiskFree(p.repoCfg.Directory)
+		if err == nil && free-size < min {
+			return fmt.Errorf("less than the minimum of %d MiB would be left free on disk", p.repoCfg.MinDiskFreeMiB)
+		}
+	}
+	if max := int64(p.repoCfg.MaxSizeMiB) << 20; max > 0 && grow > 0 && p.localBytes+grow > max {
+		return fmt.Errorf("the repository would grow beyond the maximum of %d MiB", p.repoCfg.MaxSizeMiB)
+	}
+	return nil
+}
+
+// outOfSpace pauses pulling new files until there is space for f.
+func (p *puller) outOfSpace(f protocol.FileInfo, err error) {
+	p.spaceErr = err
+	p.spaceFile = f
+	l.Warnf(logPrefix, "Pausing pulling in repo %q: %q: %v", p.repoCfg.ID, f.Name, err)
+	events.Default.Log(events.OutOfSpace, map[string]string{
+		"repo":  p.repoCfg.ID,
+		"item":  f.Name,
+		"error": err.Error(),
+	})
+}
+
+// spaceAvailable returns true if the file that did not fit now does, or if
+// it has changed or is no longer needed so that other files may fit.
+func (p *puller) spaceAvailable() bool {
+	f := p.spaceFile
+	if gf := p.model.CurrentGlobalFile(p.repoCfg.ID, f.Name); gf.Version != f.Version {
+		return true
+	}
+	if p.repoCfg.MaxSizeMiB > 0 {
+		_, _, p.localBytes = p.model.LocalSize(p.repoCfg.ID)
+	}
+	cur := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+	if cur.Version == f.Version {
+		return true
+	}
+	return p.checkSpace(f.Size(), f.Size()-cur.Size()) == nil
+}
+
+// fail records that the file could not be synced. It is retried later, with
+// increasing delays while it keeps failing.
+func (p *puller) fail(f protocol.FileInfo, err error) {
+	p.errors++
+	item := p.model.failures.failed(p.repoCfg.ID, f, err, time.Now())
+	if debug {
+		l.Debugf(logPrefix, "pull: %q / %q failed (attempt %d): %v; retry at %v", p.repoCfg.ID, f.Name, item.Attempts, err, item.Retry)
+	}
+	events.Default.Log(events.ItemFailed, map[string]interface{}{
+		"repo":     p.repoCfg.ID,
+		"item":     f.Name,
+		"error":    item.Error,
+		"attempts": item.Attempts,
+		"retry":    item.Retry,
+	})
+}
+
+// forgetFile drops the file from the open files and stops advertising it to
+// other nodes as being downloaded.
+func (p *puller) forgetFile(name string) {
+	if of, ok := p.openFiles[name]; ok {
+		of.verifier.cancel()
+		if of.record != nil {
+			of.record.Close()
+		}
+	}
+	delete(p.openFiles, name)
+	p.model.downloads.finished(p.repoCfg.ID, name)
+}
+
+// blockIndex returns the index of the block at the given offset.
+func blockIndex(offset int64) uint32 {
+	return uint32(offset / protocol.BlockSize)
+}
+
+// blockHashOK returns true if the data matches the hash of the block at the
+// given offset in the file.
+func blockHashOK(f protocol.FileInfo, offset int64, data []byte) bool {
+	i := int(blockIndex(offset))
+	if i >= len(f.Blocks) {
+		return false
+	}
+	hash := sha256.Sum256(data)
+	return bytes.Equal(hash[:], f.Blocks[i].Hash)
+}
+
 func (p *puller) closeFile(f protocol.FileInfo) {
 	if debug {
 		l.Debugf(logPrefix, "pull: closing %q / %q", p.repoCfg.ID, f.Name)
 	}
 
 	of := p.openFiles[f.Name]
+	p.forgetFile(f.Name)
+
+	if of.err != nil {
+		// A block could not be fetched or written; the file is incomplete.
+		// The temporary file is kept so that the download can be resumed.
+		if of.file != nil {
+			of.file.Close()
+		}
+		p.fail(f, of.err)
+		return
+	}
+
 	err := of.file.Close()
 	if err != nil {
-		p.errors++
+		p.fail(f, err)
 		l.Infof(logPrefix, "close: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
+		return
 	}
-	defer os.Remove(of.temp)
-
-	delete(p.openFiles, f.Name)
 
 	fd, err := os.Open(of.temp)
 	if err != nil {
-		p.errors++
+		p.fail(f, err)
 		l.Infof(logPrefix, "open: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 		return
 	}
@@ -769,6 +1270,9 @@ func (p *puller) closeFile(f protocol.FileInfo) {
 		if debug {
 			l.Debugf(logPrefix, "pull: %q / %q: nblocks %d != %d", p.repoCfg.ID, f.Name, l0, l1)
 		}
+		os.Remove(of.temp)
+		os.Remove(blockRecordName(of.filepath))
+		p.fail(f, errHashMismatch)
 		return
 	}
 
@@ -777,6 +1281,9 @@ func (p *puller) closeFile(f protocol.FileInfo) {
 			if debug {
 				l.Debugf(logPrefix, "pull: %q / %q: block %d hash mismatch\n  have: %x\n  want: %x", p.repoCfg.ID, f.Name, i, hb[i].Hash, f.Blocks[i].Hash)
 			}
+			os.Remove(of.temp)
+			os.Remove(blockRecordName(of.filepath))
+			p.fail(f, errHashMismatch)
 			return
 		}
 	}
@@ -795,12 +1302,17 @@ func (p *puller) closeFile(f protocol.FileInfo) {
 
 	osutil.ShowFile(of.temp)
 
-	if p.versioner != nil {
+	// Files being served can't be replaced on some platforms
+	p.model.fds.forget(of.filepath)
+	if p.moveConflict(f, of.filepath) {
+		// Our copy is kept under another name, nothing to archive
+	} else if p.versioner != nil {
 		err := p.versioner.Archive(of.filepath)
 		if err != nil {
 			if debug {
 				l.Debugf(logPrefix, "pull: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 			}
+			p.fail(f, err)
 			return
 		}
 	}
@@ -809,9 +1321,10 @@ func (p *puller) closeFile(f protocol.FileInfo) {
 		l.Debugf(logPrefix, "pull: rename %q / %q: %q", p.repoCfg.ID, f.Name, of.filepath)
 	}
 	if err := osutil.Rename(of.temp, of.filepath); err == nil {
+		os.Remove(blockRecordName(of.filepath))
 		p.model.updateLocal(p.repoCfg.ID, f)
 	} else {
-		p.errors++
+		p.fail(f, err)
 		l.Infof(logPrefix, "rename: error: %q / %q: %v", p.repoCfg.ID, f.Name, err)
 	}
 }
@@ -0,0 +1,109 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// In a receive only repository, changes made locally are recorded in the
+// local index with the invalid flag set. Other nodes then know that we do not
+// have a valid copy of the file, but never take our version of it, and the
+// puller leaves the file alone until the change is reverted. Reverting turns
+// the local entry into a valid one with a zero version and an empty version
+// vector, which any version in the cluster supersedes, after which the
+// puller replaces the file with the global version like any other needed
+// file.
+
+var errNotReceiveOnly = errors.New("repository is not receive only")
+
+// isLocalChange returns true if the local file entry is a change made in a
+// receive only repository that has not been reverted.
+func (m *Model) isLocalChange(repo, name string, flags uint32, version uint64) bool {
+	m.rmut.RLock()
+	receiveOnly := m.repoCfgs[repo].ReceiveOnly
+	ignores := m.repoIgnores[repo]
+	m.rmut.RUnlock()
+
+	return receiveOnly && protocol.IsInvalid(flags) && version != 0 && !ignores.Match(name)
+}
+
+// localChange returns true if our copy of the file is an unreverted change
+// made in a receive only repository.
+func (m *Model) localChange(repo, name string) bool {
+	f := m.CurrentRepoFile(repo, name)
+	return f.Name == name && m.isLocalChange(repo, name, f.Flags, f.Version)
+}
+
+// LocalChanges returns the files changed, added or deleted locally in a
+// receive only repository.
+func (m *Model) LocalChanges(repo string) []protocol.FileInfoTruncated {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var changes []protocol.FileInfoTruncated
+	rf.WithHaveTruncated(protocol.LocalNodeID, func(fi protocol.FileIntf) bool {
+		f := fi.(protocol.FileInfoTruncated)
+		if m.isLocalChange(repo, f.Name, f.Flags, f.Version) {
+			changes = append(changes, f)
+		}
+		return true
+	})
+	return changes
+}
+
+// Revert undoes the local changes in a receive only repository. Files that
+// do not exist in the cluster are removed; the others are replaced with the
+// global version by the puller.
+func (m *Model) Revert(repo string) error {
+	m.rmut.RLock()
+	rf, ok := m.repoFiles[repo]
+	cfg := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return errNoSuchRepo
+	}
+	if !cfg.ReceiveOnly {
+		return errNotReceiveOnly
+	}
+
+	// Going backwards, files are removed before the directories they are in
+	changes := m.LocalChanges(repo)
+	var batch []protocol.FileInfo
+	for i := len(changes) - 1; i >= 0; i-- {
+		f := rf.Get(protocol.LocalNodeID, changes[i].Name)
+		f.Version = 0
+		f.Vector = protocol.Vector{}
+		f.Flags &^= protocol.FlagInvalid
+		if gf := rf.GetGlobal(f.Name); gf.Name != f.Name || gf.IsDeleted() {
+			if !f.IsDeleted() {
+				err := os.Remove(filepath.Join(cfg.Directory, f.Name))
+				if err != nil && !os.IsNotExist(err) {
+					l.Infof(logPrefix, "revert: error: %q / %q: %v", repo, f.Name, err)
+					continue
+				}
+			}
+			f.Flags |= protocol.FlagDeleted
+			f.Blocks = nil
+		}
+		if debug {
+			l.Debugf(logPrefix, "revert: %q / %q", repo, f.Name)
+		}
+		batch = append(batch, f)
+	}
+
+	if len(batch) > 0 {
+		rf.Update(protocol.LocalNodeID, batch)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/syncthing/events"
+	"github.com/syncthing/syncthing/files"
+	"github.com/syncthing/syncthing/lamport"
+	"github.com/syncthing/syncthing/osutil"
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// A rename shows up in the index as a deleted file and a new file with the
+// same blocks. The scanner makes sure the two are indexed together, so that
+// the puller on other nodes sees both at once and can move the file instead
+// of deleting it and pulling it again.
+
+// blocksEqual returns true if the two block lists describe the same data.
+func blocksEqual(a, b []protocol.BlockInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Size != b[i].Size || !bytes.Equal(a[i].Hash, b[i].Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// renameCandidate returns true if the file has data that is worth moving
+// rather than pulling again.
+func renameCandidate(f protocol.FileInfo) bool {
+	if protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) || protocol.IsInvalid(f.Flags) {
+		return false
+	}
+	return len(f.Blocks) > 0 && f.Blocks[0].Size > 0
+}
+
+// blocksKey returns a map key identifying the block list.
+func blocksKey(bs []protocol.BlockInfo) string {
+	var buf bytes.Buffer
+	for _, b := range bs {
+		buf.Write(b.Hash)
+	}
+	return buf.String()
+}
+
+// renamedFrom returns the deleted entry for the local file that the newly
+// scanned file f was renamed or moved from, if any. That is a file in the
+// same repository with the same blocks that no longer exists on disk. Names
+// in skip have already been used as the source of a rename.
+func (m *Model) renamedFrom(repo, dir string, f protocol.FileInfo, skip map[string]bool) (protocol.FileInfo, bool) {
+	if !renameCandidate(f) {
+		return protocol.FileInfo{}, false
+	}
+
+	m.rmut.RLock()
+	fs := m.repoFiles[repo]
+	m.rmut.RUnlock()
+
+	// The block map keeps one offset per file and hash, which need not be
+	// that of the first block, so every file with the hash is a candidate.
+	var old protocol.FileInfo
+	found := m.finder.Iterate(f.Blocks[0].Hash, func(r, name string, _ int64) bool {
+		if r != repo || name == f.Name || skip[name] {
+			return false
+		}
+		cf := fs.Get(protocol.LocalNodeID, name)
+		if cf.Name != name || !renameCandidate(cf) || !blocksEqual(cf.Blocks, f.Blocks) {
+			return false
+		}
+		if _, err := os.Lstat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			return false
+		}
+		old = cf
+		return true
+	})
+	if !found {
+		return protocol.FileInfo{}, false
+	}
+
+	if debug {
+		l.Debugf(logPrefix, "scan: %q / %q was renamed to %q", repo, old.Name, f.Name)
+	}
+	return protocol.FileInfo{
+		Name:     old.Name,
+		Flags:    old.Flags | protocol.FlagDeleted,
+		Modified: old.Modified,
+		Version:  lamport.Default.Tick(old.Version),
+		Vector:   old.Vector.Update(m.shortID),
+	}, true
+}
+
+// renameSources returns the needed deletions of local files with the same
+// blocks as one of the files to be pulled, that are not in the list
+// already. Deletions are otherwise only pulled once all other needed files
+// fit in a batch, which would keep the new and old names of a large rename
+// apart.
+func (p *puller) renameSources(rf *files.Set, fs []protocol.FileInfo, skip func(name string, version uint64) bool) []protocol.FileInfo {
+	listed := make(map[string]bool, len(fs))
+	for _, f := range fs {
+		listed[f.Name] = true
+	}
+
+	var sources []protocol.FileInfo
+	for _, f := range fs {
+		if !renameCandidate(f) {
+			continue
+		}
+		p.model.finder.Iterate(f.Blocks[0].Hash, func(repo, name string, _ int64) bool {
+			if repo != p.repoCfg.ID || listed[name] {
+				return false
+			}
+			lf := rf.Get(protocol.LocalNodeID, name)
+			if lf.Name != name || !renameCandidate(lf) || !blocksEqual(lf.Blocks, f.Blocks) {
+				return false
+			}
+			gf := rf.GetGlobal(name)
+			if gf.Name != name || !gf.IsDeleted() || gf.Version == lf.Version || skip(name, gf.Version) {
+				return false
+			}
+			listed[name] = true
+			sources = append(sources, gf)
+			return true
+		})
+	}
+	return sources
+}
+
+// handleRenames finds the files in the list that are renames of local files,
+// i.e. new files with the same blocks as a local file that is to be deleted,
+// and moves the local files into place. Returns the files that still need
+// to be pulled.
+func (p *puller) handleRenames(files []protocol.FileInfo) []protocol.FileInfo {
+	deleted := make(map[string]int) // blocks key -> index in files
+	for i, f := range files {
+		if !protocol.IsDeleted(f.Flags) || protocol.IsDirectory(f.Flags) {
+			continue
+		}
+		lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name)
+		if lf.Name == f.Name && renameCandidate(lf) {
+			deleted[blocksKey(lf.Blocks)] = i
+		}
+	}
+	if len(deleted) == 0 {
+		return files
+	}
+
+	handled := make(map[int]bool)
+	for i, f := range files {
+		if !renameCandidate(f) {
+			continue
+		}
+		j, ok := deleted[blocksKey(f.Blocks)]
+		if !ok {
+			continue
+		}
+		if lf := p.model.CurrentRepoFile(p.repoCfg.ID, f.Name); lf.Name == f.Name && !protocol.IsDeleted(lf.Flags) {
+			// We have another version of the file; not a rename
+			continue
+		}
+		if p.moveFile(files[j], f) {
+			handled[i] = true
+			handled[j] = true
+			delete(deleted, blocksKey(f.Blocks))
+		}
+	}
+
+	rest := files[:0]
+	for i, f := range files {
+		if !handled[i] {
+			rest = append(rest, f)
+		}
+	}
+	return rest
+}
+
+// moveFile renames the local file from to the new file to, and records the
+// deletion of from and the creation of to. Returns true if the file was
+// moved.
+func (p *puller) moveFile(from, to protocol.FileInfo) bool {
+	fromPath := filepath.Join(p.repoCfg.Directory, from.Name)
+	toPath := filepath.Join(p.repoCfg.Directory, to.Name)
+
+	if _, err := os.Lstat(toPath); !os.IsNotExist(err) {
+		// Don't overwrite a file that we don't know about
+		return false
+	}
+
+	err := os.MkdirAll(filepath.Dir(toPath), 0777)
+	if err != nil {
+		l.Infof(logPrefix, "mkdir: error: %q / %q: %v", p.repoCfg.ID, to.Name, err)
+		return false
+	}
+	p.model.fds.forget(fromPath)
+	err = osutil.Rename(fromPath, toPath)
+	if err != nil {
+		l.Infof(logPrefix, "rename: error: %q / %q -> %q: %v", p.repoCfg.ID, from.Name, to.Name, err)
+		return false
+	}
+
+	t := time.Unix(to.Modified, 0)
+	err = os.Chtimes(toPath, t, t)
+	if err != nil {
+		l.Infof(logPrefix, "chtimes: error: %q / %q: %v", p.repoCfg.ID, to.Name, err)
+	}
+	if !p.repoCfg.IgnorePerms && protocol.HasPermissionBits(to.Flags) {
+		err = os.Chmod(toPath, os.FileMode(to.Flags&0777))
+		if err != nil {
+			l.Infof(logPrefix, "chmod: error: %q / %q: %v", p.repoCfg.ID, to.Name, err)
+		}
+	}
+
+	if debug {
+		l.Debugf(logPrefix, "pull: moved %q / %q to %q", p.repoCfg.ID, from.Name, to.Name)
+	}
+	events.Default.Log(events.ItemStarted, map[string]string{
+		"repo": p.repoCfg.ID,
+		"item": to.Name,
+	})
+
+	p.model.updateLocal(p.repoCfg.ID, from)
+	p.model.updateLocal(p.repoCfg.ID, to)
+	return true
+}
@@ -0,0 +1,148 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+// A download interrupted by a disconnect or restart leaves its temporary
+// file behind, along with a record of the version being downloaded and the
+// blocks written to it so far. When the same version is pulled again, the
+// recorded blocks are not fetched again; the complete file is verified
+// before use as always. A temporary file without a record for the version,
+// such as one left by an earlier version of the file, is verified block by
+// block in the background while the download proceeds.
+
+// blockRecordName returns the name of the record of the blocks in the
+// temporary file for the named file. It is temporary itself, but can't be
+// the temporary name of any file.
+func blockRecordName(name string) string {
+	return filepath.Join(filepath.Dir(name), defTempNamer.prefix+"-blocks."+filepath.Base(name))
+}
+
+// openBlockRecord opens the record of the blocks in a temporary file being
+// downloaded to, for appending, and returns the blocks recorded. If
+// resuming is false, or there is no record for the given version, a new
+// record is started and found is false.
+func openBlockRecord(path string, version uint64, resuming bool) (fd *os.File, blocks []uint32, found bool, err error) {
+	if resuming {
+		data, err := ioutil.ReadFile(path)
+		if err == nil && len(data) >= 8 && binary.BigEndian.Uint64(data) == version {
+			fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			// A partly written index at the end is ignored
+			for i := 8; i+4 <= len(data); i += 4 {
+				blocks = append(blocks, binary.BigEndian.Uint32(data[i:]))
+			}
+			return fd, blocks, true, nil
+		}
+	}
+
+	fd, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	var hdr [8]byte
+	binary.BigEndian.PutUint64(hdr[:], version)
+	if _, err := fd.Write(hdr[:]); err != nil {
+		fd.Close()
+		return nil, nil, false, err
+	}
+	return fd, nil, false, nil
+}
+
+// recordBlock adds the block to the record, if there is one. The record only
+// saves work on resuming, so errors are not fatal.
+func recordBlock(fd *os.File, index uint32) {
+	if fd == nil {
+		return
+	}
+	var bs [4]byte
+	binary.BigEndian.PutUint32(bs[:], index)
+	if _, err := fd.Write(bs[:]); err != nil && debug {
+		l.Debugf(logPrefix, "pull: recording block %d in %q: %v", index, fd.Name(), err)
+	}
+}
+
+// verifyBlocks calls fn with the index of each block that is present with
+// the right contents in the file, until stop is closed.
+func verifyBlocks(fd *os.File, blocks []protocol.BlockInfo, stop <-chan struct{}, fn func(index uint32)) {
+	var buf []byte
+	for _, b := range blocks {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if b.Size == 0 {
+			continue
+		}
+		if cap(buf) < int(b.Size) {
+			buf = make([]byte, b.Size)
+		}
+		buf = buf[:b.Size]
+		if _, err := fd.ReadAt(buf, b.Offset); err != nil {
+			return
+		}
+		hash := sha256.Sum256(buf)
+		if bytes.Equal(hash[:], b.Hash) {
+			fn(blockIndex(b.Offset))
+		}
+	}
+}
+
+// A tempVerifier looks for the blocks that are already present in a
+// temporary file, in the background.
+type tempVerifier struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// verifyTemp starts verifying the blocks of the temporary file, calling fn
+// from another goroutine with the index of each block found to be correct.
+func verifyTemp(temp string, blocks []protocol.BlockInfo, fn func(index uint32)) *tempVerifier {
+	v := &tempVerifier{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(v.done)
+		fd, err := os.Open(temp)
+		if err != nil {
+			return
+		}
+		defer fd.Close()
+		verifyBlocks(fd, blocks, v.stop, fn)
+	}()
+	return v
+}
+
+// cancel stops the verification and waits for it to let go of the file. A
+// nil verifier does nothing.
+func (v *tempVerifier) cancel() {
+	if v == nil {
+		return
+	}
+	close(v.stop)
+	<-v.done
+}
+
+// gotBlock records that the block is present in the temporary file of the
+// open file.
+func (p *puller) gotBlock(name string, of openFile, index uint32) {
+	p.model.downloads.gotBlock(p.repoCfg.ID, name, index)
+	recordBlock(of.record, index)
+}
@@ -0,0 +1,166 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Changes seen by the watcher are scanned once no more have been seen for
+// watchDelay, or watchMaxDelay after the first one at the latest. If more
+// than watchMaxSubs paths changed, their parent directories are scanned
+// instead.
+const (
+	watchDelay    = 1 * time.Second
+	watchMaxDelay = 10 * time.Second
+	watchMaxSubs  = 64
+)
+
+// A watched repository is still scanned in full this often, in case the
+// watcher missed a change.
+const watchRescanInterval = 1 * time.Hour
+
+var errWatchUnsupported = errors.New("watching for changes is not supported on this platform")
+
+// WatchRepo starts watching the repository directory for changes and
+// scanning the changed parts of it as they happen.
+func (m *Model) WatchRepo(repo string) error {
+	m.rmut.RLock()
+	cfg, ok := m.repoCfgs[repo]
+	m.rmut.RUnlock()
+	if !ok {
+		return errNoSuchRepo
+	}
+
+	changes, err := watchDir(cfg.Directory, func(name string) bool {
+		return m.watchIgnored(repo, name)
+	})
+	if err != nil {
+		return err
+	}
+	go m.scanChanges(repo, changes)
+	return nil
+}
+
+// watchIgnored returns true if changes to the file or directory need not be
+// watched, as a scan would skip it anyway.
+func (m *Model) watchIgnored(repo, name string) bool {
+	if sn := filepath.Base(name); sn == ".stversions" || defTempNamer.IsTemporary(name) {
+		return true
+	}
+
+	m.rmut.RLock()
+	ignores := m.repoIgnores[repo]
+	m.rmut.RUnlock()
+	return ignores.Match(name)
+}
+
+// scanChanges scans the paths received on the channel, relative to the
+// repository root, after waiting for the changes to settle. An empty path
+// means that the whole repository must be scanned.
+func (m *Model) scanChanges(repo string, changes <-chan string) {
+	pending := make(map[string]bool)
+	var first time.Time
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case name, ok := <-changes:
+			if !ok {
+				return
+			}
+			if name == ".stignore" {
+				// What is ignored may have changed anywhere
+				name = ""
+			}
+			pending[name] = true
+
+			now := time.Now()
+			if first.IsZero() {
+				first = now
+			}
+			delay := watchDelay
+			if left := first.Add(watchMaxDelay).Sub(now); left < delay {
+				delay = left
+			}
+			timer = time.After(delay)
+
+		case <-timer:
+			timer = nil
+			for _, sub := range scanSubs(pending, watchMaxSubs) {
+				if debug {
+					l.Debugf(logPrefix, "%q: scanning changes in %q", repo, sub)
+				}
+				err := m.ScanRepoSub(repo, sub)
+				if err == ErrRepoPaused {
+					// Keep the changes until the repository is resumed
+					timer = time.After(watchMaxDelay)
+					break
+				}
+				if err != nil {
+					l.Infof(logPrefix, "%q: scanning %q: %v", repo, sub, err)
+				}
+			}
+			if timer == nil {
+				pending = make(map[string]bool)
+				first = time.Time{}
+
+				// Files held back while being written to may see no
+				// further changes, so look at them again once they may
+				// have become stable.
+				m.rmut.RLock()
+				stable := time.Duration(m.repoCfgs[repo].StableTimeS) * time.Second
+				m.rmut.RUnlock()
+				if stable < watchDelay {
+					// Files that kept changing while being hashed
+					stable = watchDelay
+				}
+				for _, f := range m.HeldFiles(repo) {
+					if !f.InProgress {
+						pending[f.Name] = true
+					}
+				}
+				if len(pending) > 0 {
+					first = time.Now()
+					timer = time.After(stable)
+				}
+			}
+		}
+	}
+}
+
+// scanSubs returns the smallest set of subtrees that covers the changed
+// paths and has at most max entries.
+func scanSubs(paths map[string]bool, max int) []string {
+	for {
+		var subs []string
+		for name := range paths {
+			covered := name != "" && paths[""]
+			for dir := filepath.Dir(name); !covered && dir != "."; dir = filepath.Dir(dir) {
+				covered = paths[dir]
+			}
+			if !covered {
+				subs = append(subs, name)
+			}
+		}
+		if len(subs) <= max {
+			sort.Strings(subs)
+			return subs
+		}
+
+		parents := make(map[string]bool, len(subs))
+		for _, name := range subs {
+			dir := filepath.Dir(name)
+			if dir == "." {
+				dir = ""
+			}
+			parents[dir] = true
+		}
+		paths = parents
+	}
+}
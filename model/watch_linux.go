@@ -0,0 +1,149 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// An inotifyWatcher watches a directory tree. Inotify watches are not
+// recursive, so every directory in the tree is watched separately.
+type inotifyWatcher struct {
+	fd      int
+	dir     string
+	ignored func(name string) bool
+	names   map[int32]string // watch descriptor -> directory, relative to dir
+	changes chan string
+}
+
+// watchDir watches the directory tree and sends the paths, relative to dir,
+// of changed files and directories on the returned channel. Files and
+// directories for which ignored returns true are not watched. An empty path
+// means that changes may have been missed anywhere in the tree.
+func watchDir(dir string, ignored func(name string) bool) (<-chan string, error) {
+	fd, err := syscall.InotifyInit()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &inotifyWatcher{
+		fd:      fd,
+		dir:     dir,
+		ignored: ignored,
+		names:   make(map[int32]string),
+		changes: make(chan string, 1024),
+	}
+	if err := w.addTree(""); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	go w.run()
+	return w.changes, nil
+}
+
+// addTree watches the directory and the directories below it.
+func (w *inotifyWatcher) addTree(name string) error {
+	return filepath.Walk(filepath.Join(w.dir, name), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			// Vanished since, or a file
+			return nil
+		}
+		rn, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return nil
+		}
+		if rn == "." {
+			rn = ""
+		} else if w.ignored(rn) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		w.names[int32(wd)] = rn
+		return nil
+	})
+}
+
+// removeTree stops watching the directory and the directories below it.
+func (w *inotifyWatcher) removeTree(name string) {
+	for wd, rn := range w.names {
+		if rn == name || strings.HasPrefix(rn, name+string(os.PathSeparator)) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.names, wd)
+		}
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			l.Warnf("Watching %q: %v", w.dir, err)
+			syscall.Close(w.fd)
+			close(w.changes)
+			return
+		}
+
+		for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			nameBytes := buf[i+syscall.SizeofInotifyEvent : i+syscall.SizeofInotifyEvent+int(ev.Len)]
+			i += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if debug {
+					l.Debugf(logPrefix, "watch: %q: event queue overflow", w.dir)
+				}
+				w.changes <- ""
+				continue
+			}
+
+			dir, ok := w.names[ev.Wd]
+			if !ok {
+				// Removed or ignored watch
+				continue
+			}
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.names, ev.Wd)
+				continue
+			}
+
+			name := dir
+			if ev.Len > 0 {
+				name = filepath.Join(dir, strings.TrimRight(string(nameBytes), "\x00"))
+			}
+			if name == "" || w.ignored(name) {
+				continue
+			}
+
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				switch {
+				case ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+					if err := w.addTree(name); err != nil {
+						l.Infof(logPrefix, "Watching %q: %v", filepath.Join(w.dir, name), err)
+					}
+				case ev.Mask&syscall.IN_MOVED_FROM != 0:
+					w.removeTree(name)
+				}
+			}
+
+			w.changes <- name
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package model
+
+func watchDir(dir string, ignored func(name string) bool) (<-chan string, error) {
+	return nil, errWatchUnsupported
+}
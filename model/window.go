@@ -0,0 +1,139 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package model
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/config"
+	"github.com/syncthing/syncthing/protocol"
+	"github.com/syncthing/syncthing/scanner"
+)
+
+// The throughput of a node is sampled over windowSampleInterval at a time.
+// A gap of more than windowIdleTimeout between two blocks means the node was
+// idle and the sample is discarded, so that idle time isn't taken for a slow
+// link.
+const (
+	windowSampleInterval = 1 * time.Second
+	windowIdleTimeout    = 5 * time.Second
+)
+
+type throughput struct {
+	rate  float64   // smoothed bytes per second, zero until measured
+	start time.Time // start of the current sample
+	last  time.Time // when the last block was received
+	bytes int       // received in the current sample
+}
+
+// A throughputTracker measures how fast blocks are received from each node.
+type throughputTracker struct {
+	nodes map[protocol.NodeID]*throughput
+	mut   sync.Mutex
+}
+
+func newThroughputTracker() *throughputTracker {
+	return &throughputTracker{
+		nodes: make(map[protocol.NodeID]*throughput),
+	}
+}
+
+// received records that a block of the given size arrived from the node.
+func (t *throughputTracker) received(node protocol.NodeID, bytes int, now time.Time) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	tp, ok := t.nodes[node]
+	if !ok {
+		tp = &throughput{}
+		t.nodes[node] = tp
+	}
+	if now.Sub(tp.last) > windowIdleTimeout {
+		tp.start = now
+		tp.bytes = 0
+	}
+	tp.last = now
+	tp.bytes += bytes
+
+	if d := now.Sub(tp.start); d >= windowSampleInterval {
+		rate := float64(tp.bytes) / d.Seconds()
+		if tp.rate == 0 {
+			tp.rate = rate
+		} else {
+			tp.rate += (rate - tp.rate) / 4
+		}
+		tp.start = now
+		tp.bytes = 0
+	}
+}
+
+// rate returns the measured throughput from the node in bytes per second,
+// or zero if unknown.
+func (t *throughputTracker) rate(node protocol.NodeID) float64 {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if tp, ok := t.nodes[node]; ok {
+		return tp.rate
+	}
+	return 0
+}
+
+func (t *throughputTracker) forget(node protocol.NodeID) {
+	t.mut.Lock()
+	delete(t.nodes, node)
+	t.mut.Unlock()
+}
+
+// requestWindow returns the number of requests to keep outstanding to a node
+// with the given throughput and round trip time. That is the number of
+// blocks that fit in twice the bandwidth-delay product of the link, which
+// keeps it busy without queueing more than needed. As the throughput is
+// limited by the window itself, the extra room lets the window grow until
+// the link is saturated. Until both are known the configured number of
+// parallel requests is used.
+func requestWindow(rate float64, rtt time.Duration, opts config.OptionsConfiguration) int {
+	min, max := opts.MinRequestWindow, opts.MaxRequestWindow
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	window := opts.ParallelRequests
+	if rate > 0 && rtt > 0 {
+		window = int(math.Ceil(2 * rate * rtt.Seconds() / scanner.StandardBlockSize))
+	}
+
+	if window < min {
+		return min
+	}
+	if window > max {
+		return max
+	}
+	return window
+}
+
+// requestWindow returns the number of requests a puller may have
+// outstanding to the node.
+func (m *Model) requestWindow(node protocol.NodeID) int {
+	m.pmut.RLock()
+	conn, ok := m.protoConn[node]
+	m.pmut.RUnlock()
+
+	var rtt time.Duration
+	if ok {
+		// The ping round trip time doesn't include time spent in queues
+		// behind our own requests, unlike the request latency.
+		q := conn.Statistics().LinkQuality
+		rtt = q.RTT
+		if rtt == 0 {
+			rtt = q.Latency()
+		}
+	}
+	return requestWindow(m.rates.rate(node), rtt, m.cfg.Options)
+}
@@ -0,0 +1,12 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package osutil
+
+import "errors"
+
+// DiskFree is not implemented on Solaris.
+func DiskFree(path string) (int64, error) {
+	return 0, errors.New("not implemented")
+}
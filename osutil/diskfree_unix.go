@@ -0,0 +1,19 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin freebsd
+
+package osutil
+
+import "syscall"
+
+// DiskFree returns the number of bytes available to unprivileged users on
+// the filesystem holding the given path.
+func DiskFree(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -15,6 +15,10 @@ type TestModel struct {
 	name     string
 	offset   int64
 	size     int
+	flags    uint32
+	err      error
+	progress []FileDownloadProgress
+	index    []FileInfo
 	closedCh chan bool
 }
 
@@ -25,17 +29,20 @@ func newTestModel() *TestModel {
 }
 
 func (t *TestModel) Index(nodeID NodeID, repo string, files []FileInfo) {
+	t.index = files
 }
 
 func (t *TestModel) IndexUpdate(nodeID NodeID, repo string, files []FileInfo) {
+	t.index = files
 }
 
-func (t *TestModel) Request(nodeID NodeID, repo, name string, offset int64, size int) ([]byte, error) {
+func (t *TestModel) Request(nodeID NodeID, repo, name string, offset int64, size int, flags uint32) ([]byte, error) {
 	t.repo = repo
 	t.name = name
 	t.offset = offset
 	t.size = size
-	return t.data, nil
+	t.flags = flags
+	return t.data, t.err
 }
 
 func (t *TestModel) Close(nodeID NodeID, err error) {
@@ -45,6 +52,10 @@ func (t *TestModel) Close(nodeID NodeID, err error) {
 func (t *TestModel) ClusterConfig(nodeID NodeID, config ClusterConfigMessage) {
 }
 
+func (t *TestModel) DownloadProgress(nodeID NodeID, repo string, files []FileDownloadProgress) {
+	t.progress = files
+}
+
 func (t *TestModel) isClosed() bool {
 	select {
 	case <-t.closedCh:
@@ -0,0 +1,188 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"strconv"
+	"strings"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+)
+
+// Compression codecs, as named in configuration and Cluster Config options
+const (
+	CodecLZ4     = "lz4"
+	CodecDeflate = "deflate"
+)
+
+// Codec IDs as carried in the message header when the compression bit is set
+const (
+	codecNone    = -1
+	codecLZ4     = 0
+	codecDeflate = 1
+)
+
+var codecIDs = map[string]int{
+	CodecLZ4:     codecLZ4,
+	CodecDeflate: codecDeflate,
+}
+
+// Cluster Config options used to negotiate compression
+const (
+	compressionOption      = "compression"
+	compressionLevelOption = "compressionLevel"
+)
+
+var errUnknownCodec = errors.New("protocol error: unknown compression codec")
+
+// Messages shorter than this many bytes are never compressed
+const compressionThreshold = 128
+
+// CompressionOptions selects the compression codecs a connection may use.
+// Each side sends using the first codec in its own list that is also
+// accepted by the peer, at the lower of the two announced levels.
+type CompressionOptions struct {
+	Codecs []string // accepted codecs, most preferred first; none disables compression
+	Level  int      // DEFLATE compression level 1-9, or zero for the default
+}
+
+var (
+	DefaultCompression = CompressionOptions{Codecs: []string{CodecLZ4}}
+	NoCompression      = CompressionOptions{}
+)
+
+// ParseCodecs parses a comma separated list of codec names, skipping
+// unknown ones.
+func ParseCodecs(s string) []string {
+	var codecs []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if _, ok := codecIDs[c]; ok {
+			codecs = append(codecs, c)
+		}
+	}
+	return codecs
+}
+
+// options returns the Cluster Config options announcing the compression
+// settings.
+func (o CompressionOptions) options() []Option {
+	opts := []Option{{compressionOption, strings.Join(o.Codecs, ",")}}
+	if o.Level != 0 {
+		opts = append(opts, Option{compressionLevelOption, strconv.Itoa(o.Level)})
+	}
+	return opts
+}
+
+// peerCompression returns the compression settings announced by the peer.
+// Peers that announce nothing accept LZ4, as that is what they have always
+// understood.
+func peerCompression(cc ClusterConfigMessage) CompressionOptions {
+	for _, o := range cc.Options {
+		if o.Key == compressionOption {
+			level, _ := strconv.Atoi(cc.GetOption(compressionLevelOption))
+			return CompressionOptions{
+				Codecs: ParseCodecs(o.Value),
+				Level:  level,
+			}
+		}
+	}
+	return DefaultCompression
+}
+
+// negotiateCompression returns the codec ID and level to use when sending
+// to the peer.
+func negotiateCompression(local, peer CompressionOptions) (int, int) {
+	level := local.Level
+	if level == 0 || (peer.Level != 0 && peer.Level < level) {
+		level = peer.Level
+	}
+
+	for _, c := range local.Codecs {
+		for _, pc := range peer.Codecs {
+			if c == pc {
+				if id, ok := codecIDs[c]; ok {
+					return id, level
+				}
+			}
+		}
+	}
+	return codecNone, level
+}
+
+func codecName(id int) string {
+	for name, cid := range codecIDs {
+		if cid == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// compressor compresses messages, keeping and reusing a DEFLATE writer
+// between calls.
+type compressor struct {
+	fw    *flate.Writer
+	level int
+}
+
+// compress appends the data compressed with the given codec to dst.
+func (c *compressor) compress(dst, data []byte, codec, level int) ([]byte, error) {
+	switch codec {
+	case codecLZ4:
+		start := len(dst)
+		maxLen := start + lz4.CompressBound(len(data))
+		if maxLen > cap(dst) {
+			ndst := make([]byte, start, maxLen)
+			copy(ndst, dst)
+			dst = ndst
+		}
+		enc, err := lz4.Encode(dst[start:maxLen], data)
+		return dst[:start+len(enc)], err
+
+	case codecDeflate:
+		if level < 1 || level > 9 {
+			level = flate.DefaultCompression
+		}
+		buf := bytes.NewBuffer(dst)
+		if c.fw == nil || c.level != level {
+			fw, err := flate.NewWriter(buf, level)
+			if err != nil {
+				return dst, err
+			}
+			c.fw, c.level = fw, level
+		} else {
+			c.fw.Reset(buf)
+		}
+		if _, err := c.fw.Write(data); err != nil {
+			return dst, err
+		}
+		err := c.fw.Close()
+		return buf.Bytes(), err
+	}
+
+	panic("bug: unknown codec")
+}
+
+// decompress returns the data decompressed with the given codec, reusing
+// dst if it is large enough.
+func decompress(dst, data []byte, codec int) ([]byte, error) {
+	switch codec {
+	case codecLZ4:
+		return lz4.Decode(dst[:cap(dst)], data)
+
+	case codecDeflate:
+		buf := bytes.NewBuffer(dst[:0])
+		fr := flate.NewReader(bytes.NewReader(data))
+		_, err := buf.ReadFrom(fr)
+		fr.Close()
+		return buf.Bytes(), err
+	}
+
+	return nil, errUnknownCodec
+}
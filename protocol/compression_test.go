@@ -0,0 +1,126 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseCodecs(t *testing.T) {
+	codecs := ParseCodecs(" Deflate, foo,lz4,")
+	if len(codecs) != 2 || codecs[0] != CodecDeflate || codecs[1] != CodecLZ4 {
+		t.Errorf("Incorrect codecs %v", codecs)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	both := CompressionOptions{Codecs: []string{CodecDeflate, CodecLZ4}, Level: 9}
+	lz4Only := CompressionOptions{Codecs: []string{CodecLZ4}}
+
+	cases := []struct {
+		local, peer CompressionOptions
+		codec       int
+		level       int
+	}{
+		{both, both, codecDeflate, 9},
+		{both, lz4Only, codecLZ4, 9},
+		{lz4Only, both, codecLZ4, 9},
+		{both, CompressionOptions{Codecs: []string{CodecDeflate}, Level: 3}, codecDeflate, 3},
+		{both, NoCompression, codecNone, 9},
+		{NoCompression, both, codecNone, 9},
+	}
+
+	for i, tc := range cases {
+		codec, level := negotiateCompression(tc.local, tc.peer)
+		if codec != tc.codec || level != tc.level {
+			t.Errorf("%d: incorrect negotiation %d/%d != %d/%d", i, codec, level, tc.codec, tc.level)
+		}
+	}
+}
+
+func TestPeerCompression(t *testing.T) {
+	// Peers that don't announce anything get what they have always had
+	if c := peerCompression(ClusterConfigMessage{}); len(c.Codecs) != 1 || c.Codecs[0] != CodecLZ4 {
+		t.Errorf("Incorrect legacy peer codecs %v", c.Codecs)
+	}
+
+	cc := ClusterConfigMessage{Options: CompressionOptions{Codecs: []string{CodecDeflate}, Level: 4}.options()}
+	if c := peerCompression(cc); len(c.Codecs) != 1 || c.Codecs[0] != CodecDeflate || c.Level != 4 {
+		t.Errorf("Incorrect peer compression %v", c)
+	}
+
+	cc = ClusterConfigMessage{Options: NoCompression.options()}
+	if c := peerCompression(cc); len(c.Codecs) != 0 {
+		t.Errorf("Incorrect peer codecs %v", c.Codecs)
+	}
+}
+
+func TestCompressRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("some compressible data "), 1000)
+	hdr := []byte("headerxx")
+
+	var comp compressor
+	for _, codec := range []int{codecLZ4, codecDeflate} {
+		for _, level := range []int{0, 1, 9} {
+			bs, err := comp.compress(hdr[:8:8], data, codec, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bs[:8], hdr) {
+				t.Errorf("%d/%d: prefix was overwritten", codec, level)
+			}
+			if len(bs)-8 >= len(data) {
+				t.Errorf("%d/%d: data was not compressed", codec, level)
+			}
+
+			dec, err := decompress(nil, bs[8:], codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Errorf("%d/%d: incorrect decompressed data", codec, level)
+			}
+		}
+	}
+
+	if _, err := decompress(nil, data, 3); err != errUnknownCodec {
+		t.Errorf("Unexpected error %v for unknown codec", err)
+	}
+}
+
+func TestDeflateConnection(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = bytes.Repeat([]byte("response data "), 1000)
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	opts := CompressionOptions{Codecs: []string{CodecDeflate, CodecLZ4}}
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", opts)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", opts)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	d, err := c0.Request("default", "foo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, m1.data) {
+		t.Error("Incorrect response data")
+	}
+
+	s := c1.Statistics()
+	if s.Compression != CodecDeflate {
+		t.Errorf("Incorrect compression %q", s.Compression)
+	}
+	if s.CompressionRatio < 10 {
+		t.Errorf("Unexpectedly low compression ratio %f", s.CompressionRatio)
+	}
+}
@@ -6,6 +6,7 @@ package protocol
 
 import (
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -62,3 +63,147 @@ func (c *countingWriter) Last() time.Time {
 func TotalInOut() (uint64, uint64) {
 	return atomic.LoadUint64(&totalIncoming), atomic.LoadUint64(&totalOutgoing)
 }
+
+// Traffic holds the number of bytes sent and received on the wire, by
+// message type and by repository.
+type Traffic struct {
+	InBytesByType  map[string]uint64
+	OutBytesByType map[string]uint64
+	InBytesByRepo  map[string]uint64
+	OutBytesByRepo map[string]uint64
+}
+
+func NewTraffic() Traffic {
+	return Traffic{
+		InBytesByType:  make(map[string]uint64),
+		OutBytesByType: make(map[string]uint64),
+		InBytesByRepo:  make(map[string]uint64),
+		OutBytesByRepo: make(map[string]uint64),
+	}
+}
+
+// Add returns the sum of t and o.
+func (t Traffic) Add(o Traffic) Traffic {
+	return t.combine(o, func(a, b uint64) uint64 { return a + b })
+}
+
+// Sub returns the difference between t and an earlier snapshot o of the
+// same counters.
+func (t Traffic) Sub(o Traffic) Traffic {
+	return t.combine(o, func(a, b uint64) uint64 { return a - b })
+}
+
+func (t Traffic) combine(o Traffic, fn func(a, b uint64) uint64) Traffic {
+	r := NewTraffic()
+	for _, p := range []struct{ r, a, b map[string]uint64 }{
+		{r.InBytesByType, t.InBytesByType, o.InBytesByType},
+		{r.OutBytesByType, t.OutBytesByType, o.OutBytesByType},
+		{r.InBytesByRepo, t.InBytesByRepo, o.InBytesByRepo},
+		{r.OutBytesByRepo, t.OutBytesByRepo, o.OutBytesByRepo},
+	} {
+		for k, v := range p.a {
+			p.r[k] = fn(v, p.b[k])
+		}
+		for k, v := range p.b {
+			if _, ok := p.a[k]; !ok {
+				p.r[k] = fn(0, v)
+			}
+		}
+	}
+	return r
+}
+
+type trafficCounter struct {
+	mut sync.Mutex
+	t   Traffic
+}
+
+var totalTraffic = trafficCounter{t: NewTraffic()}
+
+func (c *trafficCounter) add(in bool, msgType int, repo string, n int) {
+	c.mut.Lock()
+	if c.t.InBytesByType == nil {
+		c.t = NewTraffic()
+	}
+	byType, byRepo := c.t.OutBytesByType, c.t.OutBytesByRepo
+	if in {
+		byType, byRepo = c.t.InBytesByType, c.t.InBytesByRepo
+	}
+	byType[messageTypeName(msgType)] += uint64(n)
+	if repo != "" {
+		byRepo[repo] += uint64(n)
+	}
+	c.mut.Unlock()
+}
+
+func (c *trafficCounter) traffic() Traffic {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.t.Add(Traffic{})
+}
+
+// countMessage records a message of n bytes on the wire in the connection's
+// and the global traffic counters.
+func (c *rawConnection) countMessage(in bool, hdr header, msg encodable, n int) {
+	repo := messageRepo(msg)
+	if in && hdr.msgType == messageTypeResponse {
+		// Responses don't say which repository they concern, but the
+		// request they answer did.
+		c.awaitingMut.Lock()
+		repo = c.awaitingRepo[hdr.msgID]
+		c.awaitingMut.Unlock()
+	}
+	c.traffic.add(in, hdr.msgType, repo, n)
+	totalTraffic.add(in, hdr.msgType, repo, n)
+}
+
+// messageRepo returns the repository the message concerns, if any.
+func messageRepo(msg encodable) string {
+	switch msg := msg.(type) {
+	case IndexMessage:
+		return msg.Repository
+	case indexMessageV0:
+		return msg.Repository
+	case RequestMessage:
+		return msg.Repository
+	case requestMessageV0:
+		return msg.Repository
+	case DownloadProgressMessage:
+		return msg.Repository
+	case repoMessage:
+		return msg.repo
+	}
+	return ""
+}
+
+// repoMessage tags a message that does not carry a repository ID with the
+// repository it concerns, for traffic accounting.
+type repoMessage struct {
+	encodable
+	repo string
+}
+
+func messageTypeName(msgType int) string {
+	switch msgType {
+	case messageTypeClusterConfig:
+		return "clusterConfig"
+	case messageTypeIndex, messageTypeIndexUpdate:
+		return "index"
+	case messageTypeRequest:
+		return "request"
+	case messageTypeResponse:
+		return "response"
+	case messageTypePing, messageTypePong:
+		return "ping"
+	case messageTypeClose:
+		return "close"
+	case messageTypeDownloadProgress:
+		return "downloadProgress"
+	default:
+		return "unknown"
+	}
+}
+
+func TotalTraffic() Traffic {
+	return totalTraffic.traffic()
+}
@@ -11,6 +11,7 @@ type header struct {
 	msgID       int
 	msgType     int
 	compression bool
+	codec       int // valid when compression is set
 }
 
 func (h header) encodeXDR(xw *xdr.Writer) (int, error) {
@@ -28,6 +29,7 @@ func encodeHeader(h header) uint32 {
 	var isComp uint32
 	if h.compression {
 		isComp = 1 << 0 // the zeroth bit is the compression bit
+		isComp += uint32(h.codec&0x3) << 1
 	}
 	return uint32(h.version&0xf)<<28 +
 		uint32(h.msgID&0xfff)<<16 +
@@ -41,5 +43,6 @@ func decodeHeader(u uint32) header {
 		msgID:       int(u>>16) & 0xfff,
 		msgType:     int(u>>8) & 0xff,
 		compression: u&1 == 1,
+		codec:       int(u>>1) & 0x3,
 	}
 }
@@ -0,0 +1,89 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// LinkQuality describes the latency of a connection as moving averages.
+// Zero values mean that nothing has been measured yet.
+type LinkQuality struct {
+	RTT            time.Duration // round trip time of pings
+	RTTJitter      time.Duration // mean deviation of the round trip time
+	RequestLatency time.Duration // time from sending a request until its response arrives
+	RequestJitter  time.Duration // mean deviation of the request latency
+	PingsLost      int           // pings that got no response in time
+}
+
+// Latency returns the best available estimate of the time it takes to get
+// a block from the peer, or zero if unknown.
+func (q LinkQuality) Latency() time.Duration {
+	if q.RequestLatency > 0 {
+		return q.RequestLatency
+	}
+	return q.RTT
+}
+
+// latencyAverage keeps a smoothed average and mean deviation of latency
+// samples, the same way as TCP does for its retransmission timer (RFC 6298).
+type latencyAverage struct {
+	avg    time.Duration
+	jitter time.Duration
+}
+
+func (a *latencyAverage) add(d time.Duration) {
+	if a.avg == 0 {
+		a.avg = d
+		a.jitter = d / 2
+		return
+	}
+	dev := d - a.avg
+	if dev < 0 {
+		dev = -dev
+	}
+	a.jitter += (dev - a.jitter) / 4
+	a.avg += (d - a.avg) / 8
+}
+
+type latencyTracker struct {
+	rtt     latencyAverage
+	request latencyAverage
+	lost    int
+	mut     sync.Mutex
+}
+
+func (t *latencyTracker) addRTT(d time.Duration) {
+	t.mut.Lock()
+	t.rtt.add(d)
+	t.mut.Unlock()
+}
+
+// addLost records a ping that timed out. It says nothing about the round
+// trip time, as the pong may just be queued behind other traffic.
+func (t *latencyTracker) addLost() {
+	t.mut.Lock()
+	t.lost++
+	t.mut.Unlock()
+}
+
+func (t *latencyTracker) addRequest(d time.Duration) {
+	t.mut.Lock()
+	t.request.add(d)
+	t.mut.Unlock()
+}
+
+func (t *latencyTracker) quality() LinkQuality {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return LinkQuality{
+		RTT:            t.rtt.avg,
+		RTTJitter:      t.rtt.jitter,
+		RequestLatency: t.request.avg,
+		RequestJitter:  t.request.jitter,
+		PingsLost:      t.lost,
+	}
+}
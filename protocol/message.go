@@ -17,12 +17,13 @@ type FileInfo struct {
 	Modified     int64
 	Version      uint64
 	LocalVersion uint64
+	Vector       Vector
 	Blocks       []BlockInfo
 }
 
 func (f FileInfo) String() string {
-	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Size:%d, Blocks:%v}",
-		f.Name, f.Flags, f.Modified, f.Version, f.Size(), f.Blocks)
+	return fmt.Sprintf("File{Name:%q, Flags:0%o, Modified:%d, Version:%d, Vector:%v, Size:%d, Blocks:%v}",
+		f.Name, f.Flags, f.Modified, f.Version, f.Vector, f.Size(), f.Blocks)
 }
 
 func (f FileInfo) Size() (bytes int64) {
@@ -50,6 +51,7 @@ type FileInfoTruncated struct {
 	Modified     int64
 	Version      uint64
 	LocalVersion uint64
+	Vector       Vector
 	NumBlocks    uint32
 }
 
@@ -73,6 +75,56 @@ func (f FileInfoTruncated) IsInvalid() bool {
 	return IsInvalid(f.Flags)
 }
 
+// The Index message as sent in protocol versions 0 to 2, without version
+// vectors
+type indexMessageV0 struct {
+	Repository string // max:64
+	Files      []fileInfoV0
+}
+
+type fileInfoV0 struct {
+	Name         string // max:8192
+	Flags        uint32
+	Modified     int64
+	Version      uint64
+	LocalVersion uint64
+	Blocks       []BlockInfo
+}
+
+func (f fileInfoV0) fileInfo() FileInfo {
+	return FileInfo{
+		Name:         f.Name,
+		Flags:        f.Flags,
+		Modified:     f.Modified,
+		Version:      f.Version,
+		LocalVersion: f.LocalVersion,
+		Blocks:       f.Blocks,
+	}
+}
+
+// UnmarshalXDRV0 decodes a FileInfo from the format used before version
+// vectors were introduced. The resulting file has an empty vector.
+func (f *FileInfo) UnmarshalXDRV0(bs []byte) error {
+	var f0 fileInfoV0
+	if err := f0.UnmarshalXDR(bs); err != nil {
+		return err
+	}
+	*f = f0.fileInfo()
+	return nil
+}
+
+// A Vector is a version vector; it holds a counter per node that has changed
+// the file, sorted on node short ID. Files last changed before version
+// vectors were introduced have an empty vector.
+type Vector struct {
+	Counters []Counter
+}
+
+type Counter struct {
+	ID    uint64
+	Value uint64
+}
+
 type FileIntf interface {
 	Size() int64
 	IsDeleted() bool
@@ -94,10 +146,25 @@ type RequestMessage struct {
 	Name       string // max:8192
 	Offset     uint64
 	Size       uint32
+	Flags      uint32
+}
+
+// The Request message as sent in protocol versions 0 and 1, without flags
+type requestMessageV0 struct {
+	Repository string // max:64
+	Name       string // max:8192
+	Offset     uint64
+	Size       uint32
 }
 
 type ResponseMessage struct {
 	Data []byte
+	Code int32
+}
+
+// The Response message as sent in protocol version 0, without error code
+type responseMessageV0 struct {
+	Data []byte
 }
 
 type ClusterConfigMessage struct {
@@ -132,6 +199,17 @@ type Option struct {
 	Value string // max:1024
 }
 
+type DownloadProgressMessage struct {
+	Repository string // max:64
+	Files      []FileDownloadProgress
+}
+
+type FileDownloadProgress struct {
+	Name    string // max:8192
+	Version uint64
+	Blocks  []uint32 // indexes of the blocks we have
+}
+
 type CloseMessage struct {
 	Reason string // max:1024
 }
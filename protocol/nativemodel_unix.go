@@ -20,14 +20,18 @@ func (m nativeModel) IndexUpdate(nodeID NodeID, repo string, files []FileInfo) {
 	m.next.IndexUpdate(nodeID, repo, files)
 }
 
-func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int) ([]byte, error) {
-	return m.next.Request(nodeID, repo, name, offset, size)
+func (m nativeModel) Request(nodeID NodeID, repo string, name string, offset int64, size int, flags uint32) ([]byte, error) {
+	return m.next.Request(nodeID, repo, name, offset, size, flags)
 }
 
 func (m nativeModel) ClusterConfig(nodeID NodeID, config ClusterConfigMessage) {
 	m.next.ClusterConfig(nodeID, config)
 }
 
+func (m nativeModel) DownloadProgress(nodeID NodeID, repo string, files []FileDownloadProgress) {
+	m.next.DownloadProgress(nodeID, repo, files)
+}
+
 func (m nativeModel) Close(nodeID NodeID, err error) {
 	m.next.Close(nodeID, err)
 }
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"regexp"
@@ -57,6 +58,12 @@ func (n NodeID) String() string {
 	return id
 }
 
+// Short returns the first 64 bits of the node ID, used to identify the node
+// in version vectors.
+func (n NodeID) Short() uint64 {
+	return binary.BigEndian.Uint64(n[:8])
+}
+
 func (n NodeID) GoString() string {
 	return n.String()
 }
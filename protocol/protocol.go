@@ -10,10 +10,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	lz4 "github.com/bkaradzic/go-lz4"
 )
 
 const (
@@ -21,16 +21,50 @@ const (
 )
 
 const (
-	messageTypeClusterConfig = 0
-	messageTypeIndex         = 1
-	messageTypeRequest       = 2
-	messageTypeResponse      = 3
-	messageTypePing          = 4
-	messageTypePong          = 5
-	messageTypeIndexUpdate   = 6
-	messageTypeClose         = 7
+	// The highest protocol version we speak. Version 1 adds an error code
+	// to the Response message. Version 2 adds flags to the Request message
+	// and the Download Progress message. Version 3 adds version vectors to
+	// the Index and Index Update messages. All other messages are the same as
+	// in version 0 and are always sent as such.
+	protocolVersion = 3
+
+	// The Cluster Config option announcing the sender's protocol version
+	protocolVersionOption = "protocolVersion"
+)
+
+// Error codes carried in Response messages
+const (
+	ResponseNoError     = 0
+	ResponseGeneric     = 1
+	ResponseNoSuchFile  = 2
+	ResponseInvalidFile = 3
+)
+
+const (
+	messageTypeClusterConfig    = 0
+	messageTypeIndex            = 1
+	messageTypeRequest          = 2
+	messageTypeResponse         = 3
+	messageTypePing             = 4
+	messageTypePong             = 5
+	messageTypeIndexUpdate      = 6
+	messageTypeClose            = 7
+	messageTypeDownloadProgress = 8
+)
+
+// Outgoing messages are queued in separate lanes by priority, so that bulk
+// index data does not hold up requests, responses and pings.
+const (
+	laneControl = iota // ping, pong, cluster config, close
+	laneData           // request, response
+	laneIndex          // index, index update
+	numLanes
 )
 
+// Index messages larger than about this many bytes (uncompressed) are sent
+// as several smaller messages, letting other traffic through in between.
+const maxIndexMessageSize = 256 * 1024
+
 const (
 	stateInitial = iota
 	stateCCRcvd
@@ -44,6 +78,10 @@ const (
 	FlagNoPermBits        = 1 << 15
 )
 
+const (
+	FlagRequestTemporary uint32 = 1 << 0 // serve the block from a file being downloaded
+)
+
 const (
 	FlagShareTrusted  uint32 = 1 << 0
 	FlagShareReadOnly        = 1 << 1
@@ -53,6 +91,11 @@ const (
 var (
 	ErrClusterHash = fmt.Errorf("configuration error: mismatched cluster hash")
 	ErrClosed      = errors.New("connection closed")
+	ErrTimeout     = errors.New("request timed out")
+	ErrCanceled    = errors.New("request canceled")
+	ErrGeneric     = errors.New("generic error")
+	ErrNoSuchFile  = errors.New("no such file")
+	ErrInvalid     = errors.New("file is invalid")
 )
 
 type Model interface {
@@ -61,9 +104,11 @@ type Model interface {
 	// An index update was received from the peer node
 	IndexUpdate(nodeID NodeID, repo string, files []FileInfo)
 	// A request was made by the peer node
-	Request(nodeID NodeID, repo string, name string, offset int64, size int) ([]byte, error)
+	Request(nodeID NodeID, repo string, name string, offset int64, size int, flags uint32) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(nodeID NodeID, config ClusterConfigMessage)
+	// The peer node told us which files it is downloading
+	DownloadProgress(nodeID NodeID, repo string, files []FileDownloadProgress)
 	// The peer node closed the connection
 	Close(nodeID NodeID, err error)
 }
@@ -74,30 +119,46 @@ type Connection interface {
 	Index(repo string, files []FileInfo) error
 	IndexUpdate(repo string, files []FileInfo) error
 	Request(repo string, name string, offset int64, size int) ([]byte, error)
+	RequestDeadline(repo string, name string, offset int64, size int, flags uint32, deadline time.Time, cancel <-chan struct{}) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	DownloadProgress(repo string, files []FileDownloadProgress)
 	Statistics() Statistics
 }
 
 type rawConnection struct {
+	// Accessed atomically, so kept first for 64 bit alignment
+	outUncompTot uint64 // bytes of outgoing messages before compression
+	outWireTot   uint64 // bytes of outgoing messages on the wire
+
 	id       NodeID
 	name     string
 	receiver Model
 	state    int
 
+	peerVersion int32         // protocol version announced by the peer in its cluster config; accessed atomically
+	ccRcvd      chan struct{} // closed when the cluster config of the peer has been received
+
 	cr *countingReader
 	cw *countingWriter
 
-	awaiting    [4096]chan asyncResult
-	awaitingMut sync.Mutex
+	awaiting     [4096]chan asyncResult
+	awaitingRepo [4096]string // repository of the awaited request
+	awaitingMut  sync.Mutex
+
+	traffic trafficCounter
+	latency latencyTracker
 
 	idxMut sync.Mutex // ensures serialization of Index calls
 
 	nextID chan int
-	outbox chan hdrMsg
+	outbox [numLanes]chan hdrMsg
 	closed chan struct{}
 	once   sync.Once
 
-	compressionThreshold int // compress messages larger than this many bytes
+	compression CompressionOptions // what we accept and prefer
+	compMut     sync.Mutex         // protects sendCodec and sendLevel
+	sendCodec   int                // negotiated codec for outgoing messages
+	sendLevel   int                // negotiated level for outgoing messages
 
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
@@ -117,30 +178,35 @@ type encodable interface {
 	AppendXDR([]byte) []byte
 }
 
+// A connection is pinged when nothing has been sent or received on it for
+// pingIdleTime. It is closed when pingMaxLost pings in a row get no response
+// within pingTimeout; a busy connection is never closed for a late pong.
 const (
 	pingTimeout  = 30 * time.Second
 	pingIdleTime = 60 * time.Second
+	pingMaxLost  = 3
 )
 
-func NewConnection(nodeID NodeID, reader io.Reader, writer io.Writer, receiver Model, name string, compress bool) Connection {
+func NewConnection(nodeID NodeID, reader io.Reader, writer io.Writer, receiver Model, name string, compression CompressionOptions) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
-	compThres := 1<<31 - 1 // compression disabled
-	if compress {
-		compThres = 128 // compress messages that are 128 bytes long or larger
-	}
 	c := rawConnection{
-		id:                   nodeID,
-		name:                 name,
-		receiver:             nativeModel{receiver},
-		state:                stateInitial,
-		cr:                   cr,
-		cw:                   cw,
-		outbox:               make(chan hdrMsg),
-		nextID:               make(chan int),
-		closed:               make(chan struct{}),
-		compressionThreshold: compThres,
+		id:          nodeID,
+		name:        name,
+		receiver:    nativeModel{receiver},
+		state:       stateInitial,
+		cr:          cr,
+		cw:          cw,
+		nextID:      make(chan int),
+		closed:      make(chan struct{}),
+		ccRcvd:      make(chan struct{}),
+		compression: compression,
+		sendCodec:   codecNone, // until we know what the peer accepts
+	}
+
+	for i := range c.outbox {
+		c.outbox[i] = make(chan hdrMsg)
 	}
 
 	go c.readerLoop()
@@ -166,8 +232,18 @@ func (c *rawConnection) Index(repo string, idx []FileInfo) error {
 		return ErrClosed
 	default:
 	}
+	ver, err := c.remoteVersion(nil, nil)
+	if err != nil {
+		return err
+	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndex, IndexMessage{repo, idx})
+	for i, part := range splitIndex(idx, maxIndexMessageSize) {
+		if i == 0 {
+			c.sendIndex(ver, messageTypeIndex, repo, part)
+		} else {
+			c.sendIndex(ver, messageTypeIndexUpdate, repo, part)
+		}
+	}
 	c.idxMut.Unlock()
 	return nil
 }
@@ -179,19 +255,107 @@ func (c *rawConnection) IndexUpdate(repo string, idx []FileInfo) error {
 		return ErrClosed
 	default:
 	}
+	ver, err := c.remoteVersion(nil, nil)
+	if err != nil {
+		return err
+	}
 	c.idxMut.Lock()
-	c.send(-1, messageTypeIndexUpdate, IndexMessage{repo, idx})
+	for _, part := range splitIndex(idx, maxIndexMessageSize) {
+		c.sendIndex(ver, messageTypeIndexUpdate, repo, part)
+	}
 	c.idxMut.Unlock()
 	return nil
 }
 
+// sendIndex queues an Index or Index Update message, leaving out the version
+// vectors for peers that don't understand them.
+func (c *rawConnection) sendIndex(peerVersion, msgType int, repo string, fs []FileInfo) {
+	if peerVersion < 3 {
+		fs0 := make([]fileInfoV0, len(fs))
+		for i, f := range fs {
+			fs0[i] = fileInfoV0{f.Name, f.Flags, f.Modified, f.Version, f.LocalVersion, f.Blocks}
+		}
+		c.send(-1, msgType, indexMessageV0{repo, fs0})
+		return
+	}
+
+	hdr := header{
+		version: 3,
+		msgID:   -1,
+		msgType: msgType,
+	}
+	c.sendHeader(hdr, IndexMessage{repo, fs}, nil, nil)
+}
+
+// splitIndex splits the file list into parts that encode to roughly at most
+// maxSize bytes each. A file that is larger than maxSize on its own gets a
+// part of its own. There is always at least one, possibly empty, part.
+func splitIndex(fs []FileInfo, maxSize int) [][]FileInfo {
+	var parts [][]FileInfo
+	start, size := 0, 0
+	for i, f := range fs {
+		fsize := encodedSize(f)
+		if i > start && size+fsize > maxSize {
+			parts = append(parts, fs[start:i])
+			start, size = i, 0
+		}
+		size += fsize
+	}
+	return append(parts, fs[start:])
+}
+
+// encodedSize returns a close estimate of the XDR encoded size of the file.
+func encodedSize(f FileInfo) int {
+	size := 4 + len(f.Name) + 3 + 4 + 8 + 8 + 8 + 4 + 16*len(f.Vector.Counters) + 4
+	for _, b := range f.Blocks {
+		size += 4 + 4 + len(b.Hash)
+	}
+	return size
+}
+
 // Request returns the bytes for the specified block after fetching them from the connected peer.
 func (c *rawConnection) Request(repo string, name string, offset int64, size int) ([]byte, error) {
+	return c.RequestDeadline(repo, name, offset, size, 0, time.Time{}, nil)
+}
+
+// RequestDeadline is like Request, but gives up and returns ErrTimeout if no
+// response has arrived by the deadline, or ErrCanceled if the cancel channel
+// is closed first. A zero deadline and a nil cancel channel never trigger.
+// The message ID is freed on return, so a late response is discarded.
+func (c *rawConnection) RequestDeadline(repo string, name string, offset int64, size int, flags uint32, deadline time.Time, cancel <-chan struct{}) ([]byte, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(deadline.Sub(time.Now()))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	ver, err := c.remoteVersion(timeout, cancel)
+	if err != nil {
+		return nil, err
+	}
+	hdr := header{
+		version: 0,
+		msgType: messageTypeRequest,
+	}
+	var msg encodable = requestMessageV0{repo, name, uint64(offset), uint32(size)}
+	if ver >= 2 {
+		hdr.version = 2
+		msg = RequestMessage{repo, name, uint64(offset), uint32(size), flags}
+	} else if flags&FlagRequestTemporary != 0 {
+		// The peer can't have told us about a file it is downloading
+		return nil, ErrNoSuchFile
+	}
+
 	var id int
 	select {
 	case id = <-c.nextID:
 	case <-c.closed:
 		return nil, ErrClosed
+	case <-timeout:
+		return nil, ErrTimeout
+	case <-cancel:
+		return nil, ErrCanceled
 	}
 
 	c.awaitingMut.Lock()
@@ -200,25 +364,81 @@ func (c *rawConnection) Request(repo string, name string, offset int64, size int
 	}
 	rc := make(chan asyncResult, 1)
 	c.awaiting[id] = rc
+	c.awaitingRepo[id] = repo
 	c.awaitingMut.Unlock()
 
-	ok := c.send(id, messageTypeRequest, RequestMessage{repo, name, uint64(offset), uint32(size)})
-	if !ok {
-		return nil, ErrClosed
+	hdr.msgID = id
+	t0 := time.Now()
+	err = c.sendHeader(hdr, msg, timeout, cancel)
+	if err != nil {
+		c.forget(id, rc)
+		return nil, err
 	}
 
-	res, ok := <-rc
-	if !ok {
-		return nil, ErrClosed
+	select {
+	case res, ok := <-rc:
+		if !ok {
+			return nil, ErrClosed
+		}
+		c.latency.addRequest(time.Since(t0))
+		return res.val, res.err
+	case <-timeout:
+		c.forget(id, rc)
+		return nil, ErrTimeout
+	case <-cancel:
+		c.forget(id, rc)
+		return nil, ErrCanceled
+	}
+}
+
+// forget releases the message ID of an abandoned request, unless it has
+// already been released by a response or by the connection closing.
+func (c *rawConnection) forget(id int, rc chan asyncResult) {
+	c.awaitingMut.Lock()
+	if c.awaiting[id] == rc {
+		c.awaiting[id] = nil
 	}
-	return res.val, res.err
+	c.awaitingMut.Unlock()
 }
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	// Announce our protocol version and compression settings, without
+	// touching the caller's options
+	opts := make([]Option, len(config.Options), len(config.Options)+3)
+	copy(opts, config.Options)
+	opts = append(opts, Option{protocolVersionOption, strconv.Itoa(protocolVersion)})
+	config.Options = append(opts, c.compression.options()...)
 	c.send(-1, messageTypeClusterConfig, config)
 }
 
+// DownloadProgress sends the list of files we are downloading from the
+// repository, with the blocks we already have of each, to the peer. The list
+// replaces any previously sent for the repository. Peers that don't
+// understand the message are not sent anything.
+func (c *rawConnection) DownloadProgress(repo string, files []FileDownloadProgress) {
+	if ver, err := c.remoteVersion(nil, nil); err != nil || ver < 2 {
+		return
+	}
+	c.send(-1, messageTypeDownloadProgress, DownloadProgressMessage{repo, files})
+}
+
+// remoteVersion returns the protocol version announced by the peer, waiting
+// for its cluster config to arrive if it hasn't already. Returns an error if
+// the connection is closed, the timeout fires or cancel is closed first.
+func (c *rawConnection) remoteVersion(timeout <-chan time.Time, cancel <-chan struct{}) (int, error) {
+	select {
+	case <-c.ccRcvd:
+		return int(atomic.LoadInt32(&c.peerVersion)), nil
+	case <-c.closed:
+		return 0, ErrClosed
+	case <-timeout:
+		return 0, ErrTimeout
+	case <-cancel:
+		return 0, ErrCanceled
+	}
+}
+
 func (c *rawConnection) ping() bool {
 	var id int
 	select {
@@ -232,13 +452,34 @@ func (c *rawConnection) ping() bool {
 	c.awaiting[id] = rc
 	c.awaitingMut.Unlock()
 
-	ok := c.send(id, messageTypePing, nil)
-	if !ok {
+	t := time.NewTimer(pingTimeout)
+	defer t.Stop()
+
+	t0 := time.Now()
+	hdr := header{
+		msgID:   id,
+		msgType: messageTypePing,
+	}
+	if err := c.sendHeader(hdr, nil, t.C, nil); err != nil {
+		c.forget(id, rc)
+		if err == ErrTimeout {
+			c.latency.addLost()
+		}
 		return false
 	}
 
-	res, ok := <-rc
-	return ok && res.err == nil
+	select {
+	case res, ok := <-rc:
+		if ok && res.err == nil {
+			c.latency.addRTT(time.Since(t0))
+			return true
+		}
+		return false
+	case <-t.C:
+		c.forget(id, rc)
+		c.latency.addLost()
+		return false
+	}
 }
 
 func (c *rawConnection) readerLoop() (err error) {
@@ -258,6 +499,10 @@ func (c *rawConnection) readerLoop() (err error) {
 			return err
 		}
 
+		if hdr.version > protocolVersion {
+			return fmt.Errorf("protocol error: %s: unknown message version %d", c.id, hdr.version)
+		}
+
 		switch hdr.msgType {
 		case messageTypeIndex:
 			if c.state < stateCCRcvd {
@@ -267,10 +512,13 @@ func (c *rawConnection) readerLoop() (err error) {
 			c.state = stateIdxRcvd
 
 		case messageTypeIndexUpdate:
-			if c.state < stateIdxRcvd {
+			// An Index Update may take the place of the initial Index when
+			// the peer knows we already have the earlier parts of its index.
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: index update message in state %d", c.state)
 			}
 			c.handleIndexUpdate(msg.(IndexMessage))
+			c.state = stateIdxRcvd
 
 		case messageTypeRequest:
 			if c.state < stateIdxRcvd {
@@ -295,9 +543,20 @@ func (c *rawConnection) readerLoop() (err error) {
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
-			go c.receiver.ClusterConfig(c.id, msg.(ClusterConfigMessage))
+			cc := msg.(ClusterConfigMessage)
+			ver, _ := strconv.Atoi(cc.GetOption(protocolVersionOption))
+			atomic.StoreInt32(&c.peerVersion, int32(ver))
+			close(c.ccRcvd)
+			c.setPeerCompression(peerCompression(cc))
+			go c.receiver.ClusterConfig(c.id, cc)
 			c.state = stateCCRcvd
 
+		case messageTypeDownloadProgress:
+			if c.state < stateCCRcvd {
+				return fmt.Errorf("protocol error: download progress message in state %d", c.state)
+			}
+			c.handleDownloadProgress(msg.(DownloadProgressMessage))
+
 		case messageTypeClose:
 			return errors.New(msg.(CloseMessage).Reason)
 
@@ -341,8 +600,7 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 
 	msgBuf := c.rdbuf0
 	if hdr.compression {
-		c.rdbuf1 = c.rdbuf1[:cap(c.rdbuf1)]
-		c.rdbuf1, err = lz4.Decode(c.rdbuf1, c.rdbuf0)
+		c.rdbuf1, err = decompress(c.rdbuf1, c.rdbuf0, hdr.codec)
 		if err != nil {
 			return
 		}
@@ -362,19 +620,41 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 
 	switch hdr.msgType {
 	case messageTypeIndex, messageTypeIndexUpdate:
-		var idx IndexMessage
-		err = idx.UnmarshalXDR(msgBuf)
-		msg = idx
+		if hdr.version < 3 {
+			var idx indexMessageV0
+			err = idx.UnmarshalXDR(msgBuf)
+			fs := make([]FileInfo, len(idx.Files))
+			for i, f := range idx.Files {
+				fs[i] = f.fileInfo()
+			}
+			msg = IndexMessage{idx.Repository, fs}
+		} else {
+			var idx IndexMessage
+			err = idx.UnmarshalXDR(msgBuf)
+			msg = idx
+		}
 
 	case messageTypeRequest:
-		var req RequestMessage
-		err = req.UnmarshalXDR(msgBuf)
-		msg = req
+		if hdr.version < 2 {
+			var req requestMessageV0
+			err = req.UnmarshalXDR(msgBuf)
+			msg = RequestMessage{req.Repository, req.Name, req.Offset, req.Size, 0}
+		} else {
+			var req RequestMessage
+			err = req.UnmarshalXDR(msgBuf)
+			msg = req
+		}
 
 	case messageTypeResponse:
-		var resp ResponseMessage
-		err = resp.UnmarshalXDR(msgBuf)
-		msg = resp
+		if hdr.version == 0 {
+			var resp responseMessageV0
+			err = resp.UnmarshalXDR(msgBuf)
+			msg = ResponseMessage{Data: resp.Data}
+		} else {
+			var resp ResponseMessage
+			err = resp.UnmarshalXDR(msgBuf)
+			msg = resp
+		}
 
 	case messageTypePing, messageTypePong:
 		msg = EmptyMessage{}
@@ -389,10 +669,19 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		err = cm.UnmarshalXDR(msgBuf)
 		msg = cm
 
+	case messageTypeDownloadProgress:
+		var dp DownloadProgressMessage
+		err = dp.UnmarshalXDR(msgBuf)
+		msg = dp
+
 	default:
 		err = fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 	}
 
+	if err == nil {
+		c.countMessage(true, hdr, msg, 8+msglen)
+	}
+
 	return
 }
 
@@ -411,16 +700,34 @@ func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
 }
 
 func (c *rawConnection) handleRequest(msgID int, req RequestMessage) {
-	data, _ := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size))
+	data, err := c.receiver.Request(c.id, req.Repository, req.Name, int64(req.Offset), int(req.Size), req.Flags)
+
+	if ver, _ := c.remoteVersion(nil, nil); ver < 1 {
+		// The peer can't handle error codes
+		c.send(msgID, messageTypeResponse, repoMessage{responseMessageV0{data}, req.Repository})
+		return
+	}
+
+	hdr := header{
+		version: 1,
+		msgID:   msgID,
+		msgType: messageTypeResponse,
+	}
+	c.sendHeader(hdr, repoMessage{ResponseMessage{data, responseCode(err)}, req.Repository}, nil, nil)
+}
 
-	c.send(msgID, messageTypeResponse, ResponseMessage{data})
+func (c *rawConnection) handleDownloadProgress(dp DownloadProgressMessage) {
+	if debug {
+		l.Debugf(logPrefix, "DownloadProgress(%v, %v, %d files)", c.id, dp.Repository, len(dp.Files))
+	}
+	c.receiver.DownloadProgress(c.id, dp.Repository, dp.Files)
 }
 
 func (c *rawConnection) handleResponse(msgID int, resp ResponseMessage) {
 	c.awaitingMut.Lock()
 	if rc := c.awaiting[msgID]; rc != nil {
 		c.awaiting[msgID] = nil
-		rc <- asyncResult{resp.Data, nil}
+		rc <- asyncResult{resp.Data, responseError(resp.Code)}
 		close(rc)
 	}
 	c.awaitingMut.Unlock()
@@ -437,104 +744,179 @@ func (c *rawConnection) handlePong(msgID int) {
 }
 
 func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
-	if msgID < 0 {
-		select {
-		case id := <-c.nextID:
-			msgID = id
-		case <-c.closed:
-			return false
-		}
-	}
-
 	hdr := header{
 		version: 0,
 		msgID:   msgID,
 		msgType: msgType,
 	}
+	return c.sendHeader(hdr, msg, nil, nil) == nil
+}
+
+// sendHeader queues the message for sending like send, allocating a message
+// ID if hdr.msgID is negative. It gives up with ErrTimeout or ErrCanceled if
+// the timeout fires or cancel is closed before the message could be queued.
+func (c *rawConnection) sendHeader(hdr header, msg encodable, timeout <-chan time.Time, cancel <-chan struct{}) error {
+	if hdr.msgID < 0 {
+		select {
+		case id := <-c.nextID:
+			hdr.msgID = id
+		case <-c.closed:
+			return ErrClosed
+		case <-timeout:
+			return ErrTimeout
+		case <-cancel:
+			return ErrCanceled
+		}
+	}
 
 	select {
-	case c.outbox <- hdrMsg{hdr, msg}:
-		return true
+	case c.outbox[laneFor(hdr.msgType)] <- hdrMsg{hdr, msg}:
+		return nil
 	case <-c.closed:
-		return false
+		return ErrClosed
+	case <-timeout:
+		return ErrTimeout
+	case <-cancel:
+		return ErrCanceled
 	}
 }
 
 func (c *rawConnection) writerLoop() {
 	var msgBuf = make([]byte, 8) // buffer for wire format message, kept and reused
 	var uncBuf []byte            // buffer for uncompressed message, kept and reused
+	var comp compressor
 	for {
-		var tempBuf []byte
 		var err error
 
-		select {
-		case hm := <-c.outbox:
-			if hm.msg != nil {
-				// Uncompressed message in uncBuf
-				uncBuf = hm.msg.AppendXDR(uncBuf[:0])
-
-				if len(uncBuf) >= c.compressionThreshold {
-					// Use compression for large messages
-					hm.hdr.compression = true
-
-					// Make sure we have enough space for the compressed message plus header in msgBug
-					msgBuf = msgBuf[:cap(msgBuf)]
-					if maxLen := lz4.CompressBound(len(uncBuf)) + 8; maxLen > len(msgBuf) {
-						msgBuf = make([]byte, maxLen)
-					}
-
-					// Compressed is written to msgBuf, we keep tb for the length only
-					tempBuf, err = lz4.Encode(msgBuf[8:], uncBuf)
-					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(tempBuf)))
-					msgBuf = msgBuf[0 : len(tempBuf)+8]
+		hm, ok := c.nextMessage()
+		if !ok {
+			return
+		}
 
-					if debug {
-						l.Debugf(logPrefix, "write compressed message; %v (len=%d)", hm.hdr, len(tempBuf))
-					}
-				} else {
-					// No point in compressing very short messages
-					hm.hdr.compression = false
+		uncLen := 8
+		if hm.msg != nil {
+			// Uncompressed message in uncBuf
+			uncBuf = hm.msg.AppendXDR(uncBuf[:0])
+			uncLen += len(uncBuf)
 
-					msgBuf = msgBuf[:cap(msgBuf)]
-					if l := len(uncBuf) + 8; l > len(msgBuf) {
-						msgBuf = make([]byte, l)
-					}
+			codec, level := c.sendCompression()
+			if codec != codecNone && len(uncBuf) >= compressionThreshold {
+				// Use compression for large messages
+				hm.hdr.compression = true
+				hm.hdr.codec = codec
 
-					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(uncBuf)))
-					msgBuf = msgBuf[0 : len(uncBuf)+8]
-					copy(msgBuf[8:], uncBuf)
+				// Compressed message is written to msgBuf after the header
+				msgBuf, err = comp.compress(msgBuf[:8], uncBuf, codec, level)
+				binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(msgBuf)-8))
 
-					if debug {
-						l.Debugf(logPrefix, "write uncompressed message; %v (len=%d)", hm.hdr, len(uncBuf))
-					}
+				if debug {
+					l.Debugf(logPrefix, "write compressed message; %v (len=%d)", hm.hdr, len(msgBuf)-8)
 				}
 			} else {
-				if debug {
-					l.Debugf(logPrefix, "write empty message; %v", hm.hdr)
+				// No point in compressing very short messages
+				hm.hdr.compression = false
+
+				msgBuf = msgBuf[:cap(msgBuf)]
+				if l := len(uncBuf) + 8; l > len(msgBuf) {
+					msgBuf = make([]byte, l)
 				}
-				binary.BigEndian.PutUint32(msgBuf[4:8], 0)
-				msgBuf = msgBuf[:8]
-			}
 
-			binary.BigEndian.PutUint32(msgBuf[0:4], encodeHeader(hm.hdr))
+				binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(uncBuf)))
+				msgBuf = msgBuf[0 : len(uncBuf)+8]
+				copy(msgBuf[8:], uncBuf)
 
-			if err == nil {
-				var n int
-				n, err = c.cw.Write(msgBuf)
 				if debug {
-					l.Debugf(logPrefix, "wrote %d bytes on the wire", n)
+					l.Debugf(logPrefix, "write uncompressed message; %v (len=%d)", hm.hdr, len(uncBuf))
 				}
 			}
-			if err != nil {
-				c.close(err)
-				return
+		} else {
+			if debug {
+				l.Debugf(logPrefix, "write empty message; %v", hm.hdr)
 			}
-		case <-c.closed:
+			binary.BigEndian.PutUint32(msgBuf[4:8], 0)
+			msgBuf = msgBuf[:8]
+		}
+
+		binary.BigEndian.PutUint32(msgBuf[0:4], encodeHeader(hm.hdr))
+
+		if err == nil {
+			c.countMessage(false, hm.hdr, hm.msg, len(msgBuf))
+			atomic.AddUint64(&c.outUncompTot, uint64(uncLen))
+			atomic.AddUint64(&c.outWireTot, uint64(len(msgBuf)))
+
+			var n int
+			n, err = c.cw.Write(msgBuf)
+			if debug {
+				l.Debugf(logPrefix, "wrote %d bytes on the wire", n)
+			}
+		}
+		if err != nil {
+			c.close(err)
 			return
 		}
 	}
 }
 
+// setPeerCompression selects the codec for outgoing messages based on what
+// the peer accepts.
+func (c *rawConnection) setPeerCompression(peer CompressionOptions) {
+	codec, level := negotiateCompression(c.compression, peer)
+	if debug {
+		l.Debugf(logPrefix, "%s: compression %q level %d", c.id, codecName(codec), level)
+	}
+	c.compMut.Lock()
+	c.sendCodec, c.sendLevel = codec, level
+	c.compMut.Unlock()
+}
+
+func (c *rawConnection) sendCompression() (int, int) {
+	c.compMut.Lock()
+	defer c.compMut.Unlock()
+	return c.sendCodec, c.sendLevel
+}
+
+// laneFor returns the outbox lane used for the given message type.
+func laneFor(msgType int) int {
+	switch msgType {
+	case messageTypeRequest, messageTypeResponse:
+		return laneData
+	case messageTypeIndex, messageTypeIndexUpdate, messageTypeDownloadProgress:
+		return laneIndex
+	default:
+		return laneControl
+	}
+}
+
+// nextMessage waits for the next message to write, preferring control
+// messages over requests and responses, and those over index data. Returns
+// false if the connection was closed.
+func (c *rawConnection) nextMessage() (hdrMsg, bool) {
+	select {
+	case hm := <-c.outbox[laneControl]:
+		return hm, true
+	default:
+	}
+
+	select {
+	case hm := <-c.outbox[laneControl]:
+		return hm, true
+	case hm := <-c.outbox[laneData]:
+		return hm, true
+	default:
+	}
+
+	select {
+	case hm := <-c.outbox[laneControl]:
+		return hm, true
+	case hm := <-c.outbox[laneData]:
+		return hm, true
+	case hm := <-c.outbox[laneIndex]:
+		return hm, true
+	case <-c.closed:
+		return hdrMsg{}, false
+	}
+}
+
 func (c *rawConnection) close(err error) {
 	c.once.Do(func() {
 		close(c.closed)
@@ -566,14 +948,18 @@ func (c *rawConnection) idGenerator() {
 
 func (c *rawConnection) pingerLoop() {
 	var rc = make(chan bool, 1)
+	var lost int
 	ticker := time.Tick(pingIdleTime / 2)
 	for {
 		select {
 		case <-ticker:
+			// A busy connection is evidently alive. Its latency is
+			// measured by the requests on it.
 			if d := time.Since(c.cr.Last()); d < pingIdleTime {
 				if debug {
 					l.Debugln(logPrefix, c.id, "ping skipped after rd", d)
 				}
+				lost = 0
 				continue
 			}
 			if d := time.Since(c.cw.Last()); d < pingIdleTime {
@@ -590,14 +976,20 @@ func (c *rawConnection) pingerLoop() {
 			}()
 			select {
 			case ok := <-rc:
+				if ok {
+					if debug {
+						l.Debugln(logPrefix, c.id, "<- pong")
+					}
+					lost = 0
+					continue
+				}
+				lost++
 				if debug {
-					l.Debugln(logPrefix, c.id, "<- pong")
+					l.Debugln(logPrefix, c.id, "ping lost", lost)
 				}
-				if !ok {
-					c.close(fmt.Errorf("ping failure"))
+				if lost >= pingMaxLost {
+					c.close(fmt.Errorf("ping timeout"))
 				}
-			case <-time.After(pingTimeout):
-				c.close(fmt.Errorf("ping timeout"))
 			case <-c.closed:
 				return
 			}
@@ -609,16 +1001,58 @@ func (c *rawConnection) pingerLoop() {
 }
 
 type Statistics struct {
-	At            time.Time
-	InBytesTotal  uint64
-	OutBytesTotal uint64
+	At               time.Time
+	InBytesTotal     uint64
+	OutBytesTotal    uint64
+	Compression      string  // codec used for outgoing messages, empty if none
+	CompressionRatio float64 // size of outgoing messages before compression / on the wire
+	Traffic
+	LinkQuality
 }
 
 func (c *rawConnection) Statistics() Statistics {
+	codec, _ := c.sendCompression()
+	ratio := 1.0
+	if wire := atomic.LoadUint64(&c.outWireTot); wire > 0 {
+		ratio = float64(atomic.LoadUint64(&c.outUncompTot)) / float64(wire)
+	}
 	return Statistics{
-		At:            time.Now(),
-		InBytesTotal:  c.cr.Tot(),
-		OutBytesTotal: c.cw.Tot(),
+		At:               time.Now(),
+		InBytesTotal:     c.cr.Tot(),
+		OutBytesTotal:    c.cw.Tot(),
+		Compression:      codecName(codec),
+		CompressionRatio: ratio,
+		Traffic:          c.traffic.traffic(),
+		LinkQuality:      c.latency.quality(),
+	}
+}
+
+// responseCode returns the Response error code corresponding to the error
+// returned by Model.Request.
+func responseCode(err error) int32 {
+	switch err {
+	case nil:
+		return ResponseNoError
+	case ErrNoSuchFile:
+		return ResponseNoSuchFile
+	case ErrInvalid:
+		return ResponseInvalidFile
+	default:
+		return ResponseGeneric
+	}
+}
+
+// responseError returns the error corresponding to a Response error code.
+func responseError(code int32) error {
+	switch code {
+	case ResponseNoError:
+		return nil
+	case ResponseNoSuchFile:
+		return ErrNoSuchFile
+	case ResponseInvalidFile:
+		return ErrInvalid
+	default:
+		return ErrGeneric
 	}
 }
 
@@ -16,6 +16,7 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/calmh/xdr"
 )
@@ -68,8 +69,8 @@ func TestPing(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, nil, "name", true).(wireFormatConnection).next.(*rawConnection)
-	c1 := NewConnection(c1ID, br, aw, nil, "name", true).(wireFormatConnection).next.(*rawConnection)
+	c0 := NewConnection(c0ID, ar, bw, nil, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+	c1 := NewConnection(c1ID, br, aw, nil, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -79,6 +80,60 @@ func TestPing(t *testing.T) {
 	}
 }
 
+func TestLinkQuality(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	if q := c0.Statistics().LinkQuality; q != (LinkQuality{}) {
+		t.Errorf("Unexpected link quality %+v before measuring", q)
+	}
+
+	if ok := c0.(wireFormatConnection).next.(*rawConnection).ping(); !ok {
+		t.Fatal("ping failed")
+	}
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	q := c0.Statistics().LinkQuality
+	if q.RTT <= 0 || q.RequestLatency <= 0 {
+		t.Errorf("Missing measurements in %+v", q)
+	}
+	if q.Latency() != q.RequestLatency {
+		t.Errorf("Latency should prefer the request latency; %v != %v", q.Latency(), q.RequestLatency)
+	}
+}
+
+func TestLatencyAverage(t *testing.T) {
+	var a latencyAverage
+	a.add(100 * time.Millisecond)
+	if a.avg != 100*time.Millisecond || a.jitter != 50*time.Millisecond {
+		t.Errorf("Incorrect initial average %v/%v", a.avg, a.jitter)
+	}
+
+	a.add(180 * time.Millisecond)
+	if a.avg != 110*time.Millisecond || a.jitter != 57500*time.Microsecond {
+		t.Errorf("Incorrect average %v/%v", a.avg, a.jitter)
+	}
+
+	for i := 0; i < 100; i++ {
+		a.add(20 * time.Millisecond)
+	}
+	if a.avg > 21*time.Millisecond || a.jitter > time.Millisecond {
+		t.Errorf("Average %v/%v should converge on a steady latency", a.avg, a.jitter)
+	}
+}
+
 func TestPingErr(t *testing.T) {
 	e := errors.New("something broke")
 
@@ -92,8 +147,8 @@ func TestPingErr(t *testing.T) {
 			eaw := &ErrPipe{PipeWriter: *aw, max: i, err: e}
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
-			c0 := NewConnection(c0ID, ar, ebw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-			NewConnection(c1ID, br, eaw, m1, "name", true)
+			c0 := NewConnection(c0ID, ar, ebw, m0, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+			NewConnection(c1ID, br, eaw, m1, "name", DefaultCompression)
 
 			res := c0.ping()
 			if (i < 8 || j < 8) && res {
@@ -168,8 +223,8 @@ func TestVersionErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -191,8 +246,8 @@ func TestTypeErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -214,8 +269,8 @@ func TestClose(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", true).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", true)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+	NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
 
 	c0.close(nil)
 
@@ -238,6 +293,325 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestRequestTimeout(t *testing.T) {
+	ar, _ := io.Pipe()
+	_, bw := io.Pipe()
+
+	// Nothing reads what c0 writes, so no request is ever answered
+	c0 := NewConnection(c0ID, ar, bw, newTestModel(), "name", DefaultCompression).(wireFormatConnection).next.(*rawConnection)
+
+	t0 := time.Now()
+	if _, err := c0.RequestDeadline("default", "foo", 0, 0, 0, t0.Add(100*time.Millisecond), nil); err != ErrTimeout {
+		t.Errorf("Unexpected error %v != %v", err, ErrTimeout)
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Errorf("Request took %v to time out", d)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, err := c0.RequestDeadline("default", "foo", 0, 0, 0, time.Time{}, cancel); err != ErrCanceled {
+		t.Errorf("Unexpected error %v != %v", err, ErrCanceled)
+	}
+
+	c0.awaitingMut.Lock()
+	for id, ch := range c0.awaiting {
+		if ch != nil {
+			t.Errorf("Message ID %d still awaiting a response", id)
+		}
+	}
+	c0.awaitingMut.Unlock()
+}
+
+func TestResponseErrorCode(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.err = ErrNoSuchFile
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	if _, err := c0.Request("default", "foo", 0, 0); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v != %v", err, ErrNoSuchFile)
+	}
+}
+
+func TestResponseToVersion0Peer(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+	m1.err = ErrNoSuchFile
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+
+	// An old peer doesn't announce its protocol version
+	c0.(wireFormatConnection).next.(*rawConnection).send(-1, messageTypeClusterConfig, ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	d, err := c0.Request("default", "foo", 0, 0)
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if string(d) != "response data" {
+		t.Errorf("Incorrect response data %q", d)
+	}
+}
+
+func TestDownloadProgress(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	files := []FileDownloadProgress{{Name: "foo", Version: 42, Blocks: []uint32{0, 3}}}
+	c0.DownloadProgress("default", files)
+
+	// The request is answered after the preceding messages are handled
+	if _, err := c0.RequestDeadline("default", "foo", 0, 0, FlagRequestTemporary, time.Time{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m1.progress, files) {
+		t.Errorf("Incorrect download progress %v", m1.progress)
+	}
+	if m1.flags != FlagRequestTemporary {
+		t.Errorf("Incorrect request flags %x", m1.flags)
+	}
+}
+
+func TestDownloadProgressToVersion0Peer(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+
+	// An old peer doesn't announce its protocol version
+	c1.(wireFormatConnection).next.(*rawConnection).send(-1, messageTypeClusterConfig, ClusterConfigMessage{})
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	// Would be a protocol error if it was sent
+	c0.DownloadProgress("default", []FileDownloadProgress{{Name: "foo"}})
+
+	if _, err := c0.RequestDeadline("default", "foo", 0, 0, FlagRequestTemporary, time.Time{}, nil); err != ErrNoSuchFile {
+		t.Errorf("Unexpected error %v for temporary request to old peer", err)
+	}
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m1.progress != nil {
+		t.Errorf("Unexpected download progress %v", m1.progress)
+	}
+}
+
+func TestIndexVectors(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	vec := Vector{}.Update(c0ID.Short()).Update(c1ID.Short())
+	files := []FileInfo{{Name: "foo", Version: 42, Vector: vec, Blocks: []BlockInfo{}}}
+	c0.IndexUpdate("default", files)
+
+	// The request is answered after the preceding messages are handled
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(m1.index) != 1 || !m1.index[0].Vector.Equal(vec) || m1.index[0].Version != 42 {
+		t.Errorf("Incorrect index %v", m1.index)
+	}
+}
+
+func TestIndexToVersion2Peer(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", DefaultCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", DefaultCompression)
+
+	// The peer announces a version without version vectors
+	cc := ClusterConfigMessage{Options: []Option{{protocolVersionOption, "2"}}}
+	c1.(wireFormatConnection).next.(*rawConnection).send(-1, messageTypeClusterConfig, cc)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", nil)
+	c1.Index("default", nil)
+
+	// Wait for the peer's cluster config to be handled
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []FileInfo{{Name: "foo", Version: 42, Vector: Vector{}.Update(c0ID.Short()), Blocks: []BlockInfo{}}}
+	c0.IndexUpdate("default", files)
+
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(m1.index) != 1 || !m1.index[0].Vector.IsEmpty() || m1.index[0].Version != 42 {
+		t.Errorf("Incorrect index %v", m1.index)
+	}
+}
+
+func TestResponseCodes(t *testing.T) {
+	for _, err := range []error{nil, ErrNoSuchFile, ErrInvalid, ErrGeneric} {
+		if e := responseError(responseCode(err)); e != err {
+			t.Errorf("Error %v did not survive the round trip; got %v", err, e)
+		}
+	}
+	if e := responseError(responseCode(errors.New("disk on fire"))); e != ErrGeneric {
+		t.Errorf("Unknown error should become %v, not %v", ErrGeneric, e)
+	}
+}
+
+func TestSplitIndex(t *testing.T) {
+	if parts := splitIndex(nil, 1024); len(parts) != 1 || len(parts[0]) != 0 {
+		t.Errorf("Empty index should give one empty part, not %v", parts)
+	}
+
+	var fs []FileInfo
+	for i := 0; i < 100; i++ {
+		fs = append(fs, FileInfo{
+			Name:   fmt.Sprintf("file%d", i),
+			Blocks: make([]BlockInfo, i%10),
+		})
+	}
+
+	parts := splitIndex(fs, 1024)
+	if len(parts) < 2 {
+		t.Fatalf("Index should have been split, got %d parts", len(parts))
+	}
+	n := 0
+	for i, part := range parts {
+		var bs []byte
+		bs = IndexMessage{"default", part}.AppendXDR(bs)
+		if len(part) > 1 && len(bs) > 1024+64 {
+			t.Errorf("Part %d is too large; %d bytes", i, len(bs))
+		}
+		n += len(part)
+	}
+	if n != len(fs) {
+		t.Errorf("Incorrect number of files in parts %d != %d", n, len(fs))
+	}
+
+	huge := []FileInfo{{Name: "huge", Blocks: make([]BlockInfo, 1000)}, {Name: "small"}}
+	if parts := splitIndex(huge, 1024); len(parts) != 2 {
+		t.Errorf("A file larger than the limit should get a part of its own, got %d parts", len(parts))
+	}
+}
+
+func TestOutboxPriority(t *testing.T) {
+	c := &rawConnection{closed: make(chan struct{})}
+	for i := range c.outbox {
+		c.outbox[i] = make(chan hdrMsg)
+	}
+
+	for _, typ := range []int{messageTypeIndex, messageTypeRequest, messageTypePing} {
+		go c.send(1, typ, nil)
+	}
+	time.Sleep(100 * time.Millisecond) // let the senders block on their lanes
+
+	for _, typ := range []int{messageTypePing, messageTypeRequest, messageTypeIndex} {
+		hm, ok := c.nextMessage()
+		if !ok {
+			t.Fatal("Unexpected closed connection")
+		}
+		if hm.hdr.msgType != typ {
+			t.Errorf("Incorrect message order; got type %d, expected %d", hm.hdr.msgType, typ)
+		}
+	}
+}
+
+func TestTrafficAccounting(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+	m1.data = []byte("response data")
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", NoCompression)
+	c1 := NewConnection(c1ID, br, aw, m1, "name", NoCompression)
+	c0.ClusterConfig(ClusterConfigMessage{})
+	c1.ClusterConfig(ClusterConfigMessage{})
+	c0.Index("default", []FileInfo{{Name: "foo"}})
+	c1.Index("default", nil)
+
+	if _, err := c0.Request("default", "foo", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s := c0.Statistics()
+	for _, typ := range []string{"clusterConfig", "index", "request"} {
+		if s.OutBytesByType[typ] == 0 {
+			t.Errorf("No outgoing %s traffic counted", typ)
+		}
+	}
+	if s.InBytesByType["response"] != 8+4+16+4 {
+		t.Errorf("Incorrect incoming response traffic %d", s.InBytesByType["response"])
+	}
+	if in := s.InBytesByRepo["default"]; in != s.InBytesByType["index"]+s.InBytesByType["response"] {
+		t.Errorf("Incorrect incoming repository traffic %d", in)
+	}
+	if out := s.OutBytesByRepo["default"]; out != s.OutBytesByType["index"]+s.OutBytesByType["request"] {
+		t.Errorf("Incorrect outgoing repository traffic %d", out)
+	}
+}
+
+func TestTrafficAddSub(t *testing.T) {
+	a := NewTraffic()
+	a.InBytesByType["index"] = 10
+	a.OutBytesByRepo["default"] = 5
+
+	b := NewTraffic()
+	b.InBytesByType["index"] = 3
+	b.InBytesByType["ping"] = 4
+
+	sum := a.Add(b)
+	if sum.InBytesByType["index"] != 13 || sum.InBytesByType["ping"] != 4 || sum.OutBytesByRepo["default"] != 5 {
+		t.Errorf("Incorrect sum %v", sum)
+	}
+	if diff := sum.Sub(b); !reflect.DeepEqual(diff.InBytesByType, map[string]uint64{"index": 10, "ping": 0}) {
+		t.Errorf("Incorrect difference %v", diff)
+	}
+}
+
 func TestElementSizeExceededNested(t *testing.T) {
 	m := ClusterConfigMessage{
 		Repositories: []Repository{
@@ -337,6 +711,29 @@ func TestMarshalCloseMessage(t *testing.T) {
 	}
 }
 
+func TestMarshalDownloadProgressMessage(t *testing.T) {
+	var quickCfg = &quick.Config{MaxCountScale: 10}
+	if testing.Short() {
+		quickCfg = nil
+	}
+
+	f := func(m1 DownloadProgressMessage) bool {
+		if len(m1.Files) == 0 {
+			m1.Files = []FileDownloadProgress{}
+		}
+		for i := range m1.Files {
+			if len(m1.Files[i].Blocks) == 0 {
+				m1.Files[i].Blocks = []uint32{}
+			}
+		}
+		return testMarshal(t, "downloadprogress", &m1, &DownloadProgressMessage{})
+	}
+
+	if err := quick.Check(f, quickCfg); err != nil {
+		t.Error(err)
+	}
+}
+
 type message interface {
 	EncodeXDR(io.Writer) (int, error)
 	DecodeXDR(io.Reader) error
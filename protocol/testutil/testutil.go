@@ -0,0 +1,122 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package testutil links protocol connections in memory, optionally
+// injecting latency, bandwidth limits, truncation and disconnects, so that
+// code using the protocol can be tested without processes or sockets.
+package testutil
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+var (
+	ErrTruncated    = errors.New("testutil: stream truncated")
+	ErrDisconnected = errors.New("testutil: random disconnect")
+	ErrClosed       = errors.New("testutil: link closed")
+)
+
+// Faults describes the misbehaviour of a link, applied to each direction
+// separately. The zero value is a perfect link.
+type Faults struct {
+	Latency        time.Duration // added to every write
+	Bandwidth      int           // bytes per second; zero means unlimited
+	TruncateAfter  int64         // cut the stream after this many bytes; zero means never
+	DisconnectProb float64       // probability of disconnecting on each write
+	Seed           int64         // seeds the random source, for repeatable disconnects
+}
+
+// Pipe returns the two ends of an in-memory stream. Data written to the
+// writer can be read from the reader, subject to the given faults.
+func Pipe(f Faults) (io.ReadCloser, io.WriteCloser) {
+	pr, pw := io.Pipe()
+	return pr, &faultyWriter{
+		pw:  pw,
+		f:   f,
+		rnd: rand.New(rand.NewSource(f.Seed)),
+	}
+}
+
+type faultyWriter struct {
+	pw      *io.PipeWriter
+	f       Faults
+	rnd     *rand.Rand
+	written int64
+	mut     sync.Mutex
+}
+
+func (w *faultyWriter) Write(bs []byte) (int, error) {
+	w.mut.Lock()
+	defer w.mut.Unlock()
+
+	if w.f.DisconnectProb > 0 && w.rnd.Float64() < w.f.DisconnectProb {
+		w.pw.CloseWithError(ErrDisconnected)
+		return 0, ErrDisconnected
+	}
+
+	if w.f.Latency > 0 {
+		time.Sleep(w.f.Latency)
+	}
+	if w.f.Bandwidth > 0 {
+		time.Sleep(time.Duration(len(bs)) * time.Second / time.Duration(w.f.Bandwidth))
+	}
+
+	if w.f.TruncateAfter > 0 && w.written+int64(len(bs)) > w.f.TruncateAfter {
+		n, _ := w.pw.Write(bs[:w.f.TruncateAfter-w.written])
+		w.written += int64(n)
+		w.pw.CloseWithError(ErrTruncated)
+		return n, ErrTruncated
+	}
+
+	n, err := w.pw.Write(bs)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *faultyWriter) Close() error {
+	return w.pw.CloseWithError(ErrClosed)
+}
+
+// Pair is two protocol connections linked to each other in memory. Conn0
+// is the connection as seen by the first node, talking to the second node,
+// and vice versa.
+type Pair struct {
+	Conn0 protocol.Connection
+	Conn1 protocol.Connection
+
+	closers []io.Closer
+	once    sync.Once
+}
+
+// NewPair connects the two models to each other, using the node IDs as the
+// connection IDs as seen from the opposite side.
+func NewPair(id0 protocol.NodeID, m0 protocol.Model, id1 protocol.NodeID, m1 protocol.Model, comp protocol.CompressionOptions, f Faults) *Pair {
+	r01, w01 := Pipe(f)
+	f.Seed++ // independent faults in the other direction
+	r10, w10 := Pipe(f)
+
+	return &Pair{
+		Conn0:   protocol.NewConnection(id1, r10, w01, m0, "testutil-0", comp),
+		Conn1:   protocol.NewConnection(id0, r01, w10, m1, "testutil-1", comp),
+		closers: []io.Closer{w01, w10, r01, r10},
+	}
+}
+
+// Close breaks the link in both directions, causing both connections to
+// close. It implements io.Closer so that it can be passed to
+// model.AddConnection as the raw connection for both sides.
+func (p *Pair) Close() error {
+	p.once.Do(func() {
+		for _, c := range p.closers {
+			c.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/protocol"
+)
+
+var (
+	id0 = protocol.NewNodeID([]byte{1})
+	id1 = protocol.NewNodeID([]byte{2})
+)
+
+type testModel struct {
+	closed chan error
+}
+
+func newTestModel() *testModel {
+	return &testModel{closed: make(chan error, 1)}
+}
+
+func (m *testModel) Index(protocol.NodeID, string, []protocol.FileInfo)       {}
+func (m *testModel) IndexUpdate(protocol.NodeID, string, []protocol.FileInfo) {}
+func (m *testModel) ClusterConfig(protocol.NodeID, protocol.ClusterConfigMessage) {
+}
+func (m *testModel) Request(nodeID protocol.NodeID, repo, name string, offset int64, size int, flags uint32) ([]byte, error) {
+	return []byte(name), nil
+}
+func (m *testModel) DownloadProgress(protocol.NodeID, string, []protocol.FileDownloadProgress) {
+}
+func (m *testModel) Close(nodeID protocol.NodeID, err error) {
+	m.closed <- err
+}
+
+func (m *testModel) waitClosed(t *testing.T) {
+	select {
+	case <-m.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection should have been closed")
+	}
+}
+
+func start(p *Pair) {
+	p.Conn0.ClusterConfig(protocol.ClusterConfigMessage{})
+	p.Conn1.ClusterConfig(protocol.ClusterConfigMessage{})
+	p.Conn0.Index("default", nil)
+	p.Conn1.Index("default", nil)
+}
+
+func TestPair(t *testing.T) {
+	m0, m1 := newTestModel(), newTestModel()
+	p := NewPair(id0, m0, id1, m1, protocol.DefaultCompression, Faults{})
+	start(p)
+
+	if id := p.Conn0.ID(); id != id1 {
+		t.Errorf("Incorrect ID %s for connection 0", id)
+	}
+	if id := p.Conn1.ID(); id != id0 {
+		t.Errorf("Incorrect ID %s for connection 1", id)
+	}
+
+	bs, err := p.Conn0.Request("default", "foo", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "foo" {
+		t.Errorf("Incorrect response %q", bs)
+	}
+
+	p.Close()
+	m0.waitClosed(t)
+	m1.waitClosed(t)
+}
+
+func TestPipeLatencyAndBandwidth(t *testing.T) {
+	r, w := Pipe(Faults{Latency: 50 * time.Millisecond, Bandwidth: 10000})
+	go ioutil.ReadAll(r)
+
+	t0 := time.Now()
+	w.Write(make([]byte, 1000))
+	if d := time.Since(t0); d < 150*time.Millisecond {
+		t.Errorf("Write was too fast; %v", d)
+	}
+}
+
+func TestPipeTruncate(t *testing.T) {
+	r, w := Pipe(Faults{TruncateAfter: 10})
+	go func() {
+		w.Write(make([]byte, 8))
+		w.Write(make([]byte, 8))
+	}()
+
+	bs, err := ioutil.ReadAll(r)
+	if err != ErrTruncated {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if len(bs) != 10 {
+		t.Errorf("Incorrect number of bytes before truncation; %d", len(bs))
+	}
+}
+
+func TestPairDisconnect(t *testing.T) {
+	m0, m1 := newTestModel(), newTestModel()
+	p := NewPair(id0, m0, id1, m1, protocol.DefaultCompression, Faults{DisconnectProb: 1})
+	start(p)
+
+	m0.waitClosed(t)
+	m1.waitClosed(t)
+	if _, err := p.Conn0.Request("default", "foo", 0, 0); err == nil {
+		t.Error("Request on disconnected pair should fail")
+	}
+}
+
+func TestPipeRepeatable(t *testing.T) {
+	writes := func() int {
+		r, w := Pipe(Faults{DisconnectProb: 0.1, Seed: 42})
+		go io.Copy(ioutil.Discard, r)
+		n := 0
+		for ; n < 1000; n++ {
+			if _, err := w.Write([]byte("x")); err != nil {
+				break
+			}
+		}
+		return n
+	}
+
+	if a, b := writes(), writes(); a != b {
+		t.Errorf("Disconnects should be repeatable; %d != %d", a, b)
+	}
+}
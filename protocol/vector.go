@@ -0,0 +1,150 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ordering is the result of comparing two version vectors.
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Greater
+	Lesser
+	Concurrent
+)
+
+// IsEmpty returns true if the vector has no counters.
+func (v Vector) IsEmpty() bool {
+	return len(v.Counters) == 0
+}
+
+// Update returns a copy of the vector with the counter for the given node
+// incremented.
+func (v Vector) Update(id uint64) Vector {
+	cs := make([]Counter, 0, len(v.Counters)+1)
+	done := false
+	for _, c := range v.Counters {
+		switch {
+		case c.ID == id:
+			c.Value++
+			done = true
+		case c.ID > id && !done:
+			cs = append(cs, Counter{id, 1})
+			done = true
+		}
+		cs = append(cs, c)
+	}
+	if !done {
+		cs = append(cs, Counter{id, 1})
+	}
+	return Vector{cs}
+}
+
+// Merge returns a vector holding the highest value of each counter in the
+// two vectors, i.e. a vector that is Greater than or Equal to both.
+func (v Vector) Merge(b Vector) Vector {
+	cs := make([]Counter, 0, len(v.Counters)+len(b.Counters))
+	i, j := 0, 0
+	for i < len(v.Counters) || j < len(b.Counters) {
+		switch {
+		case j == len(b.Counters) || i < len(v.Counters) && v.Counters[i].ID < b.Counters[j].ID:
+			cs = append(cs, v.Counters[i])
+			i++
+		case i == len(v.Counters) || b.Counters[j].ID < v.Counters[i].ID:
+			cs = append(cs, b.Counters[j])
+			j++
+		default:
+			c := v.Counters[i]
+			if b.Counters[j].Value > c.Value {
+				c.Value = b.Counters[j].Value
+			}
+			cs = append(cs, c)
+			i++
+			j++
+		}
+	}
+	return Vector{cs}
+}
+
+// Counter returns the value of the counter for the given node, or zero.
+func (v Vector) Counter(id uint64) uint64 {
+	for _, c := range v.Counters {
+		if c.ID == id {
+			return c.Value
+		}
+	}
+	return 0
+}
+
+// Compare returns how the vector orders relative to b. Greater means that
+// v has seen all changes b has and more; Concurrent means that both have
+// seen changes the other has not.
+func (v Vector) Compare(b Vector) Ordering {
+	var greater, lesser bool
+	i, j := 0, 0
+	for i < len(v.Counters) || j < len(b.Counters) {
+		switch {
+		case j == len(b.Counters) || i < len(v.Counters) && v.Counters[i].ID < b.Counters[j].ID:
+			if v.Counters[i].Value > 0 {
+				greater = true
+			}
+			i++
+		case i == len(v.Counters) || b.Counters[j].ID < v.Counters[i].ID:
+			if b.Counters[j].Value > 0 {
+				lesser = true
+			}
+			j++
+		default:
+			if v.Counters[i].Value > b.Counters[j].Value {
+				greater = true
+			} else if v.Counters[i].Value < b.Counters[j].Value {
+				lesser = true
+			}
+			i++
+			j++
+		}
+	}
+
+	switch {
+	case greater && lesser:
+		return Concurrent
+	case greater:
+		return Greater
+	case lesser:
+		return Lesser
+	}
+	return Equal
+}
+
+// Equal returns true if the two vectors hold the same counter values.
+func (v Vector) Equal(b Vector) bool {
+	return v.Compare(b) == Equal
+}
+
+func (v Vector) String() string {
+	cs := make([]string, len(v.Counters))
+	for i, c := range v.Counters {
+		cs[i] = fmt.Sprintf("%x:%d", c.ID, c.Value)
+	}
+	return "{" + strings.Join(cs, ", ") + "}"
+}
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "Equal"
+	case Greater:
+		return "Greater"
+	case Lesser:
+		return "Lesser"
+	case Concurrent:
+		return "Concurrent"
+	}
+	return "Unknown"
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2014 Jakob Borg and Contributors (see the CONTRIBUTORS file).
+// All rights reserved. Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package protocol
+
+import "testing"
+
+func vec(cs ...uint64) Vector {
+	var v Vector
+	for i := 0; i < len(cs); i += 2 {
+		v.Counters = append(v.Counters, Counter{cs[i], cs[i+1]})
+	}
+	return v
+}
+
+func TestVectorUpdate(t *testing.T) {
+	var v Vector
+
+	v = v.Update(42)
+	if exp := vec(42, 1); !v.Equal(exp) {
+		t.Errorf("%v != %v", v, exp)
+	}
+
+	v = v.Update(7).Update(42).Update(99)
+	if exp := vec(7, 1, 42, 2, 99, 1); v.String() != exp.String() {
+		t.Errorf("%v != %v", v, exp)
+	}
+
+	// Update returns a copy
+	w := v.Update(7)
+	if v.Counter(7) != 1 || w.Counter(7) != 2 {
+		t.Errorf("Update modified the original vector; %v, %v", v, w)
+	}
+}
+
+func TestVectorMerge(t *testing.T) {
+	cases := []struct {
+		a, b, m Vector
+	}{
+		{vec(), vec(), vec()},
+		{vec(1, 1), vec(), vec(1, 1)},
+		{vec(), vec(1, 1), vec(1, 1)},
+		{vec(1, 1, 3, 5), vec(2, 2, 3, 4), vec(1, 1, 2, 2, 3, 5)},
+		{vec(1, 1, 3, 4), vec(1, 2, 3, 5), vec(1, 2, 3, 5)},
+	}
+
+	for i, tc := range cases {
+		if m := tc.a.Merge(tc.b); m.String() != tc.m.String() {
+			t.Errorf("%d: %v.Merge(%v) = %v != %v", i, tc.a, tc.b, m, tc.m)
+		}
+	}
+}
+
+func TestVectorCompare(t *testing.T) {
+	cases := []struct {
+		a, b Vector
+		o    Ordering
+	}{
+		{vec(), vec(), Equal},
+		{vec(1, 1), vec(1, 1), Equal},
+		{vec(1, 0), vec(), Equal},
+		{vec(1, 1), vec(), Greater},
+		{vec(), vec(1, 1), Lesser},
+		{vec(1, 2, 2, 1), vec(1, 1, 2, 1), Greater},
+		{vec(1, 1, 2, 1), vec(1, 2), Concurrent},
+		{vec(1, 1), vec(2, 1), Concurrent},
+		{vec(1, 1, 3, 1), vec(1, 1, 2, 1, 3, 1), Lesser},
+	}
+
+	for i, tc := range cases {
+		if o := tc.a.Compare(tc.b); o != tc.o {
+			t.Errorf("%d: %v.Compare(%v) = %v != %v", i, tc.a, tc.b, o, tc.o)
+		}
+	}
+}
@@ -6,6 +6,7 @@ package protocol
 
 import (
 	"path/filepath"
+	"time"
 
 	"code.google.com/p/go.text/unicode/norm"
 )
@@ -49,10 +50,26 @@ func (c wireFormatConnection) Request(repo, name string, offset int64, size int)
 	return c.next.Request(repo, name, offset, size)
 }
 
+func (c wireFormatConnection) RequestDeadline(repo, name string, offset int64, size int, flags uint32, deadline time.Time, cancel <-chan struct{}) ([]byte, error) {
+	name = norm.NFC.String(filepath.ToSlash(name))
+	return c.next.RequestDeadline(repo, name, offset, size, flags, deadline, cancel)
+}
+
 func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
 
+func (c wireFormatConnection) DownloadProgress(repo string, fs []FileDownloadProgress) {
+	var myFs = make([]FileDownloadProgress, len(fs))
+	copy(myFs, fs)
+
+	for i := range fs {
+		myFs[i].Name = norm.NFC.String(filepath.ToSlash(myFs[i].Name))
+	}
+
+	c.next.DownloadProgress(repo, myFs)
+}
+
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
@@ -5,25 +5,38 @@
 package scanner
 
 import (
+	"errors"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/syncthing/syncthing/protocol"
 )
 
+// A file that is modified while it is being hashed is hashed again, up to
+// hashAttempts times in all, before it is left for a later scan.
+const hashAttempts = 3
+
+var errModified = errors.New("file modified while hashing")
+
+// afterHash is called, if set, with the path of each file that has been
+// hashed before checking whether it was modified meanwhile. It lets tests
+// modify files while they are being hashed.
+var afterHash func(path string)
+
 // The parallell hasher reads FileInfo structures from the inbox, hashes the
 // file to populate the Blocks element and sends it to the outbox. A number of
 // workers are used in parallel. The outbox will become closed when the inbox
 // is closed and all items handled.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo) {
+func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo, held func(string, time.Time, bool)) {
 	var wg sync.WaitGroup
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFile(dir, blockSize, outbox, inbox)
+			hashFile(dir, blockSize, outbox, inbox, held)
 			wg.Done()
 		}()
 	}
@@ -34,32 +47,32 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 	}()
 }
 
-func hashFile(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
+func hashFile(dir string, blockSize int, outbox, inbox chan protocol.FileInfo, held func(string, time.Time, bool)) {
 	for f := range inbox {
 		if protocol.IsDirectory(f.Flags) || protocol.IsDeleted(f.Flags) {
 			outbox <- f
 			continue
 		}
 
-		fd, err := os.Open(filepath.Join(dir, f.Name))
-		if err != nil {
+		var blocks []protocol.BlockInfo
+		var modified time.Time
+		var err error
+		for i := 0; i < hashAttempts; i++ {
+			blocks, modified, err = hashStable(filepath.Join(dir, f.Name), blockSize)
+			if err != errModified {
+				break
+			}
 			if debug {
-				l.Debugln("open:", err)
+				l.Debugln("modified while hashing:", f.Name)
 			}
-			continue
 		}
 
-		fi, err := fd.Stat()
-		if err != nil {
-			fd.Close()
-			if debug {
-				l.Debugln("stat:", err)
+		if err == errModified {
+			if held != nil {
+				held(f.Name, modified, false)
 			}
 			continue
 		}
-		blocks, err := Blocks(fd, blockSize, fi.Size())
-		fd.Close()
-
 		if err != nil {
 			if debug {
 				l.Debugln("hash error:", f.Name, err)
@@ -67,7 +80,43 @@ func hashFile(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
 			continue
 		}
 
+		// The file may have changed since it was seen by the walker; the
+		// blocks are those of the file as it was when hashed.
+		f.Modified = modified.Unix()
 		f.Blocks = blocks
 		outbox <- f
 	}
 }
+
+// hashStable returns the blocks and modification time of the file, or
+// errModified if its size or modification time changed while it was being
+// hashed.
+func hashStable(path string, blockSize int) ([]protocol.BlockInfo, time.Time, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer fd.Close()
+
+	before, err := fd.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	blocks, err := Blocks(fd, blockSize, before.Size())
+	if afterHash != nil {
+		afterHash(path)
+	}
+
+	// A file that was truncated while being hashed fails with an error
+	after, serr := os.Stat(path)
+	if serr == nil && (after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())) {
+		return nil, after.ModTime(), errModified
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if serr != nil {
+		return nil, time.Time{}, serr
+	}
+	return blocks, before.ModTime(), nil
+}
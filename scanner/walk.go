@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	"code.google.com/p/go.text/unicode/norm"
 
@@ -28,12 +29,29 @@ type Walker struct {
 	Ignores ignore.Patterns
 	// If TempNamer is not nil, it is used to ignore tempory files when walking.
 	TempNamer TempNamer
+	// Temporary files modified more recently than TempLifetime ago are kept
+	// by CleanTempFiles, so that interrupted downloads can be resumed. If
+	// zero, all temporary files are removed.
+	TempLifetime time.Duration
 	// If CurrentFiler is not nil, it is queried for the current file before rescanning.
 	CurrentFiler CurrentFiler
 	// If IgnorePerms is true, changes to permission bits will not be
 	// detected. Scanned files will get zero permission bits and the
 	// NoPermissionBits flag set.
 	IgnorePerms bool
+	// ShortID is the short ID of the local node. The version vectors of
+	// changed files are updated with it.
+	ShortID uint64
+	// Files modified less than StableTime ago may still be being written
+	// to and are held back until a later scan. If zero, no files are.
+	StableTime time.Duration
+	// Files matching InProgress are being written to and are held back
+	// until they no longer match, typically by being renamed.
+	InProgress ignore.Patterns
+	// If Held is not nil, it is called for each changed file that is held
+	// back, including files that kept changing while they were hashed.
+	// InProgress is true if it matched InProgress.
+	Held func(name string, modified time.Time, inProgress bool)
 }
 
 type TempNamer interface {
@@ -62,7 +80,7 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 	files := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
-	newParallelHasher(w.Dir, w.BlockSize, runtime.NumCPU(), hashedFiles, files)
+	newParallelHasher(w.Dir, w.BlockSize, runtime.NumCPU(), hashedFiles, files, w.Held)
 
 	go func() {
 		hashFiles := w.walkAndHashFiles(files)
@@ -73,7 +91,8 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 	return hashedFiles, nil
 }
 
-// CleanTempFiles removes all files that match the temporary filename pattern.
+// CleanTempFiles removes the files that match the temporary filename pattern
+// and are older than TempLifetime.
 func (w *Walker) CleanTempFiles() {
 	filepath.Walk(w.Dir, w.cleanTempFile)
 }
@@ -123,9 +142,13 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			return nil
 		}
 
+		var cf protocol.FileInfo
+		if w.CurrentFiler != nil {
+			cf = w.CurrentFiler.CurrentFile(rn)
+		}
+
 		if info.Mode().IsDir() {
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
 				if !protocol.IsDeleted(cf.Flags) && protocol.IsDirectory(cf.Flags) && permUnchanged {
 					return nil
@@ -141,6 +164,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			f := protocol.FileInfo{
 				Name:     rn,
 				Version:  lamport.Default.Tick(0),
+				Vector:   cf.Vector.Update(w.ShortID),
 				Flags:    flags,
 				Modified: info.ModTime().Unix(),
 			}
@@ -153,7 +177,6 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 
 		if info.Mode().IsRegular() {
 			if w.CurrentFiler != nil {
-				cf := w.CurrentFiler.CurrentFile(rn)
 				permUnchanged := w.IgnorePerms || !protocol.HasPermissionBits(cf.Flags) || PermsEqual(cf.Flags, uint32(info.Mode()))
 				if !protocol.IsDeleted(cf.Flags) && cf.Modified == info.ModTime().Unix() && permUnchanged {
 					return nil
@@ -164,6 +187,17 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 				}
 			}
 
+			inProgress := w.InProgress.Match(rn)
+			if inProgress || time.Since(info.ModTime()) < w.StableTime {
+				if debug {
+					l.Debugln("held back:", rn, info.ModTime(), inProgress)
+				}
+				if w.Held != nil {
+					w.Held(rn, info.ModTime(), inProgress)
+				}
+				return nil
+			}
+
 			var flags = uint32(info.Mode() & os.ModePerm)
 			if w.IgnorePerms {
 				flags = protocol.FlagNoPermBits | 0666
@@ -172,6 +206,7 @@ func (w *Walker) walkAndHashFiles(fchan chan protocol.FileInfo) filepath.WalkFun
 			fchan <- protocol.FileInfo{
 				Name:     rn,
 				Version:  lamport.Default.Tick(0),
+				Vector:   cf.Vector.Update(w.ShortID),
 				Flags:    flags,
 				Modified: info.ModTime().Unix(),
 			}
@@ -185,7 +220,7 @@ func (w *Walker) cleanTempFile(path string, info os.FileInfo, err error) error {
 	if err != nil {
 		return err
 	}
-	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) {
+	if info.Mode()&os.ModeType == 0 && w.TempNamer.IsTemporary(path) && time.Since(info.ModTime()) >= w.TempLifetime {
 		os.Remove(path)
 	}
 	return nil
@@ -7,11 +7,14 @@ package scanner
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
 	rdebug "runtime/debug"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/syncthing/syncthing/ignore"
 	"github.com/syncthing/syncthing/protocol"
@@ -111,6 +114,55 @@ func TestWalk(t *testing.T) {
 	}
 }
 
+func TestWalkHeld(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walkheld")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"done", "fresh", "data.part"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if name != "fresh" {
+			os.Chtimes(path, old, old)
+		}
+	}
+	inProgress, err := ignore.Parse(bytes.NewBufferString("*.part\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	held := make(map[string]bool)
+	w := Walker{
+		Dir:        dir,
+		BlockSize:  128 * 1024,
+		StableTime: time.Minute,
+		InProgress: inProgress,
+		Held: func(name string, modified time.Time, inProgress bool) {
+			held[name] = inProgress
+		},
+	}
+	fchan, err := w.Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for f := range fchan {
+		files = append(files, f.Name)
+	}
+
+	if len(files) != 1 || files[0] != "done" {
+		t.Errorf("Incorrect files %v", files)
+	}
+	if len(held) != 2 || held["fresh"] || !held["data.part"] {
+		t.Errorf("Incorrect held files %v", held)
+	}
+}
+
 func TestWalkError(t *testing.T) {
 	w := Walker{
 		Dir:       "testdata-missing",
@@ -170,3 +222,114 @@ func (l testfileList) String() string {
 	b.WriteString("}")
 	return b.String()
 }
+
+func TestHashFileModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The file was changed after the walker saw it
+	if err := ioutil.WriteFile(filepath.Join(dir, "f"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1234567890, 0)
+	os.Chtimes(filepath.Join(dir, "f"), mtime, mtime)
+
+	inbox := make(chan protocol.FileInfo, 2)
+	outbox := make(chan protocol.FileInfo, 2)
+	inbox <- protocol.FileInfo{Name: "f", Modified: 1}
+	inbox <- protocol.FileInfo{Name: "missing", Modified: 1}
+	close(inbox)
+	hashFile(dir, 128*1024, outbox, inbox, nil)
+	close(outbox)
+
+	var files []protocol.FileInfo
+	for f := range outbox {
+		files = append(files, f)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Incorrect files %v", files)
+	}
+	if files[0].Modified != mtime.Unix() || len(files[0].Blocks) != 1 || files[0].Blocks[0].Size != 4 {
+		t.Errorf("Blocks and modification time should match the hashed file; got %v", files[0])
+	}
+}
+
+func TestHashFileModifiedWhileHashing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { afterHash = nil }()
+
+	path := filepath.Join(dir, "f")
+	var tests = []struct {
+		changes  int // number of times the file is changed while hashed
+		attempts int
+		held     bool
+	}{
+		{0, 1, false},
+		{1, 2, false},
+		{hashAttempts - 1, hashAttempts, false},
+		{hashAttempts, hashAttempts, true},
+	}
+	for _, tc := range tests {
+		data := []byte("data")
+		mtime := time.Unix(1234567890, 0)
+		ioutil.WriteFile(path, data, 0644)
+		os.Chtimes(path, mtime, mtime)
+
+		attempts := 0
+		afterHash = func(string) {
+			attempts++
+			if attempts <= tc.changes {
+				data = append(data, "more"...)
+				mtime = mtime.Add(time.Second)
+				ioutil.WriteFile(path, data, 0644)
+				os.Chtimes(path, mtime, mtime)
+			}
+		}
+
+		var held []string
+		inbox := make(chan protocol.FileInfo, 1)
+		outbox := make(chan protocol.FileInfo, 1)
+		inbox <- protocol.FileInfo{Name: "f", Modified: 1}
+		close(inbox)
+		hashFile(dir, 128*1024, outbox, inbox, func(name string, modified time.Time, inProgress bool) {
+			if !modified.Equal(mtime) || inProgress {
+				t.Errorf("%d changes: incorrect held file %q, %v, %v", tc.changes, name, modified, inProgress)
+			}
+			held = append(held, name)
+		})
+		close(outbox)
+
+		if attempts != tc.attempts {
+			t.Errorf("%d changes: file hashed %d times, expected %d", tc.changes, attempts, tc.attempts)
+		}
+		if tc.held {
+			if len(held) != 1 || held[0] != "f" {
+				t.Errorf("%d changes: file should be held, got %v", tc.changes, held)
+			}
+			if f, ok := <-outbox; ok {
+				t.Errorf("%d changes: held file should not be sent, got %v", tc.changes, f)
+			}
+			continue
+		}
+
+		if len(held) != 0 {
+			t.Errorf("%d changes: file should not be held, got %v", tc.changes, held)
+		}
+		f, ok := <-outbox
+		if !ok {
+			t.Errorf("%d changes: file was not sent", tc.changes)
+			continue
+		}
+		blocks, _ := Blocks(bytes.NewReader(data), 128*1024, int64(len(data)))
+		if f.Modified != mtime.Unix() || !reflect.DeepEqual(f.Blocks, blocks) {
+			t.Errorf("%d changes: blocks and modification time should match the final file; got %v", tc.changes, f)
+		}
+	}
+}
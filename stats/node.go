@@ -5,6 +5,7 @@
 package stats
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/syncthing/syncthing/protocol"
@@ -13,14 +14,20 @@ import (
 
 const (
 	nodeStatisticTypeLastSeen = iota
+	nodeStatisticTypeTraffic
+	nodeStatisticTypeLinkQuality
 )
 
 var nodeStatisticsTypes = []byte{
 	nodeStatisticTypeLastSeen,
+	nodeStatisticTypeTraffic,
+	nodeStatisticTypeLinkQuality,
 }
 
 type NodeStatistics struct {
-	LastSeen time.Time
+	LastSeen    time.Time
+	Traffic     protocol.Traffic     // accumulated over all connections
+	LinkQuality protocol.LinkQuality // as last measured
 }
 
 type NodeStatisticsReference struct {
@@ -80,6 +87,76 @@ func (s *NodeStatisticsReference) WasSeen() {
 	}
 }
 
+func (s *NodeStatisticsReference) GetTraffic() protocol.Traffic {
+	t := protocol.NewTraffic()
+	value, err := s.db.Get(s.key(nodeStatisticTypeTraffic), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			l.Warnln("NodeStatisticsReference: Failed loading traffic value for", s.node, ":", err)
+		}
+		return t
+	}
+
+	err = json.Unmarshal(value, &t)
+	if err != nil {
+		l.Warnln("NodeStatisticsReference: Failed parsing traffic value for", s.node, ":", err)
+		return protocol.NewTraffic()
+	}
+	return t
+}
+
+// AddTraffic adds the given amount of traffic to the stored totals.
+func (s *NodeStatisticsReference) AddTraffic(t protocol.Traffic) {
+	if debug {
+		l.Debugln("stats.NodeStatisticsReference.AddTraffic:", s.node, t)
+	}
+	value, err := json.Marshal(s.GetTraffic().Add(t))
+	if err != nil {
+		l.Warnln("NodeStatisticsReference: Failed serializing traffic value for", s.node, ":", err)
+		return
+	}
+
+	err = s.db.Put(s.key(nodeStatisticTypeTraffic), value, nil)
+	if err != nil {
+		l.Warnln("Failed storing traffic value for", s.node, ":", err)
+	}
+}
+
+func (s *NodeStatisticsReference) GetLinkQuality() protocol.LinkQuality {
+	var q protocol.LinkQuality
+	value, err := s.db.Get(s.key(nodeStatisticTypeLinkQuality), nil)
+	if err != nil {
+		if err != leveldb.ErrNotFound {
+			l.Warnln("NodeStatisticsReference: Failed loading link quality value for", s.node, ":", err)
+		}
+		return q
+	}
+
+	err = json.Unmarshal(value, &q)
+	if err != nil {
+		l.Warnln("NodeStatisticsReference: Failed parsing link quality value for", s.node, ":", err)
+		return protocol.LinkQuality{}
+	}
+	return q
+}
+
+// SetLinkQuality stores the most recently measured link quality.
+func (s *NodeStatisticsReference) SetLinkQuality(q protocol.LinkQuality) {
+	if debug {
+		l.Debugln("stats.NodeStatisticsReference.SetLinkQuality:", s.node, q)
+	}
+	value, err := json.Marshal(q)
+	if err != nil {
+		l.Warnln("NodeStatisticsReference: Failed serializing link quality value for", s.node, ":", err)
+		return
+	}
+
+	err = s.db.Put(s.key(nodeStatisticTypeLinkQuality), value, nil)
+	if err != nil {
+		l.Warnln("Failed storing link quality value for", s.node, ":", err)
+	}
+}
+
 // Never called, maybe because it's worth while to keep the data
 // or maybe because we have no easy way of knowing that a node has been removed.
 func (s *NodeStatisticsReference) Delete() error {
@@ -97,6 +174,8 @@ func (s *NodeStatisticsReference) Delete() error {
 
 func (s *NodeStatisticsReference) GetStatistics() NodeStatistics {
 	return NodeStatistics{
-		LastSeen: s.GetLastSeen(),
+		LastSeen:    s.GetLastSeen(),
+		Traffic:     s.GetTraffic(),
+		LinkQuality: s.GetLinkQuality(),
 	}
 }